@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"datamodel"
 	_ "embed"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,25 +22,27 @@ import (
 type AuthTokenKeyType string
 type ClientKeyType string
 type URLEndpointType string
+type WorkspaceKeyType string
+type SignRequestsKeyType string
 
 const AuthTokenKey = AuthTokenKeyType("authToken")
 const ClientKey = ClientKeyType("client")
 const URLEndpointKey = URLEndpointType("urlEndpoint")
+const WorkspaceKey = WorkspaceKeyType("workspace")
+const SignRequestsKey = SignRequestsKeyType("signRequests")
 
 type TransportType int
 
+// maxRestarts is how many times the servers restart OpenGFW and ptadapter if
+// they crash
+var maxRestarts = 10
+
 const (
 	undefinedTransport TransportType = iota
 	obfsTransport
 	proteusTransport
 )
 
-var allJobs = struct {
-	JobID int `json:"job"`
-}{
-	JobID: -1,
-}
-
 func (t TransportType) String() string {
 	switch t {
 	case undefinedTransport:
@@ -50,8 +56,8 @@ func (t TransportType) String() string {
 	}
 }
 
-// starts the bridge
-func startBridge(ctxBridge context.Context, transportType TransportType, configNum int, expName, tgenPath, ptAdapterPath string) {
+// starts ptadapter on the bridge, returning once it's listening
+func startBridge(ctxBridge context.Context, transportType TransportType, configNum int, expName, ptAdapterPath, upgenPath string) datamodel.JsonJobStruct {
 
 	// send the server.tgen.graphml file to the bridge
 	graphMLBytes := getServerTgen()
@@ -74,51 +80,37 @@ func startBridge(ctxBridge context.Context, transportType TransportType, configN
 	case obfsTransport:
 		ptAdapterConfigBytes = getObfsPTAdapterServerTemplate(configNum)
 	case proteusTransport:
-		psfPath := fmt.Sprintf("../../upgen/psfs/%d.psf", configNum)
-		ptAdapterConfigBytes = getProteusPTAdapterServerTemplate(psfPath, configNum)
+		psfPath := fmt.Sprintf("%s/psfs/%d.psf", upgenPath, configNum)
+		ptAdapterConfigBytes = getProteusPTAdapterServerTemplate(upgenPath, psfPath, configNum)
 	}
 
 	if res := sendFile(ctxBridge, "ptadapter.server.conf", ptAdapterConfigBytes); res != http.StatusOK {
 		log.Fatal("could not send ptadapter.server.conf to bridge")
 	}
 
-	// next, cause the bridge to call tgen on that file
-	tgenCmd := datamodel.JsonCommandStruct{
-		TimeoutInSecs: 0,
-		Cmd:           tgenPath,
-		Args:          []string{"server.tgen.graphml"},
-		StdoutFile:    fmt.Sprintf("tgen.%v.bridge.%s.%d.log", transportType, expName, configNum),
-		StderrFile:    fmt.Sprintf("tgen.%v.bridge.%s.%d.err", transportType, expName, configNum),
-	}
-	if res := makeRequest(ctxBridge, "/runInBackground", tgenCmd); res != http.StatusOK {
-		log.Fatal("could not start tgen on bridge")
-	}
-
-	// next, cause the bridge to call ptadapter
+	// first, cause the bridge to call ptadapter
 	ptAdapterCommand := datamodel.JsonCommandStruct{
 		TimeoutInSecs: 0,
 		Cmd:           ptAdapterPath,
 		Args:          []string{"-S", "ptadapter.server.conf"},
+		Workspace:     getWorkspace(ctxBridge),
 		StdoutFile:    fmt.Sprintf("ptadapter.%v.bridge.%s.%d.log", transportType, expName, configNum),
 		StderrFile:    fmt.Sprintf("ptadapter.%v.bridge.%s.%d.err", transportType, expName, configNum),
+		Labels:        jobLabels(expName, "bridge", "ptadapter", transportType, configNum),
+		Restart:       datamodel.RestartOnFailure,
+		MaxRestarts:   maxRestarts,
+		ReadyWhen:     &datamodel.JsonReadyWhenStruct{Port: configNum + startingPortNum},
 	}
-	if res := makeRequest(ctxBridge, "/runInBackground", ptAdapterCommand); res != http.StatusOK {
+	ptAdapterJob, res := runInBackground(ctxBridge, ptAdapterCommand)
+	if res != http.StatusOK {
 		log.Fatal("could not start ptadapter on bridge")
 	}
 
-	// report out what's running
-	makeRequest(ctxBridge, "/jobs", nil)
+	return ptAdapterJob
 }
 
-// starts the censored client
-func startClient(ctxCensoredVM context.Context, transportType TransportType, configNum int, expName, tgenPath, ptAdapterPath, bridgeHostname string) {
-
-	// make sure that all tgen processes are really dead
-	killTGen := datamodel.JsonCommandStruct{
-		Cmd:  "/usr/bin/killall",
-		Args: []string{"tgen"},
-	}
-	makeRequest(ctxCensoredVM, "/runToCompletion", killTGen)
+// starts ptadapter on the censored client, returning once it's listening
+func startClient(ctxCensoredVM context.Context, transportType TransportType, configNum int, expName, ptAdapterPath, upgenPath, bridgeHostname string) datamodel.JsonJobStruct {
 
 	// send the client.tgen.graphml file to the bridge
 	graphMLBytes := getClientTgen()
@@ -137,8 +129,8 @@ func startClient(ctxCensoredVM context.Context, transportType TransportType, con
 		certString := getObsCertificatePart(m["obfs4_bridgeline.txt"])
 		ptAdapterConfigBytes = getObfsPTAdapterClientTemplate(certString, bridgeHostname, configNum)
 	case proteusTransport:
-		psfPath := fmt.Sprintf("../../upgen/psfs/%d.psf", configNum)
-		ptAdapterConfigBytes = getProteusPTAdapterClientTemplate(psfPath, bridgeHostname, configNum)
+		psfPath := fmt.Sprintf("%s/psfs/%d.psf", upgenPath, configNum)
+		ptAdapterConfigBytes = getProteusPTAdapterClientTemplate(upgenPath, psfPath, bridgeHostname, configNum)
 	}
 
 	if res := sendFile(ctxCensoredVM, "ptadapter.client.conf", ptAdapterConfigBytes); res != http.StatusOK {
@@ -150,29 +142,49 @@ func startClient(ctxCensoredVM context.Context, transportType TransportType, con
 		TimeoutInSecs: 0,
 		Cmd:           ptAdapterPath,
 		Args:          []string{"-C", "ptadapter.client.conf"},
+		Workspace:     getWorkspace(ctxCensoredVM),
 		StdoutFile:    fmt.Sprintf("ptadapter.%v.client.%s.%d.log", transportType, expName, configNum),
 		StderrFile:    fmt.Sprintf("ptadapter.%v.client.%s.%d.err", transportType, expName, configNum),
+		Labels:        jobLabels(expName, "client", "ptadapter", transportType, configNum),
+		Restart:       datamodel.RestartOnFailure,
+		MaxRestarts:   maxRestarts,
+		ReadyWhen:     &datamodel.JsonReadyWhenStruct{Port: clientListenPort},
 	}
-	if res := makeRequest(ctxCensoredVM, "/runInBackground", ptAdapterCommand); res != http.StatusOK {
+	ptAdapterJob, res := runInBackground(ctxCensoredVM, ptAdapterCommand)
+	if res != http.StatusOK {
 		log.Fatal("could not start ptadapter on client")
 	}
 
-	// next, cause the bridge to call tgen on that file
+	return ptAdapterJob
+}
+
+// has the bridge (role "bridge") or the censored client ("client") run tgen on
+// the graphml file that was sent to it, at tgenStart, returning the (held)
+// job
+func startTgen(ctx context.Context, role string, transportType TransportType, configNum int, expName, tgenPath, graphML string, tgenStart time.Time) datamodel.JsonJobStruct {
 	tgenCmd := datamodel.JsonCommandStruct{
 		TimeoutInSecs: 0,
 		Cmd:           tgenPath,
-		Args:          []string{"client.tgen.graphml"},
-		StdoutFile:    fmt.Sprintf("tgen.%v.client.%s.%d.log", transportType, expName, configNum),
-		StderrFile:    fmt.Sprintf("tgen.%v.client.%s.%d.err", transportType, expName, configNum),
+		Args:          []string{graphML},
+		Workspace:     getWorkspace(ctx),
+		StdoutFile:    fmt.Sprintf("tgen.%v.%s.%s.%d.log", transportType, role, expName, configNum),
+		StderrFile:    fmt.Sprintf("tgen.%v.%s.%s.%d.err", transportType, role, expName, configNum),
+		Labels:        jobLabels(expName, role, "tgen", transportType, configNum),
+		StartAt:       &tgenStart,
 	}
-	log.Println("running tgen on censored VM...")
-	if res := makeRequest(ctxCensoredVM, "/runInBackground", tgenCmd); res != http.StatusOK {
-		log.Fatal("could not start tgen on client")
+	log.Printf("running tgen on %s at %v...", role, tgenStart.Format(time.StampMilli))
+	tgenJob, res := runInBackground(ctx, tgenCmd)
+	if res != http.StatusOK {
+		log.Fatalf("could not start tgen on %s", role)
 	}
-	time.Sleep(3500 * time.Millisecond)
+
+	// report out what's running
+	makeRequest(ctx, "/jobs", nil)
+
+	return tgenJob
 }
 
-func startOpenGFW(ctxGFW context.Context, expName, gfwExecPath string) {
+func startOpenGFW(ctxGFW context.Context, expName, gfwExecPath string) []datamodel.JsonJobStruct {
 
 	startOpenGFWCommand := datamodel.JsonCommandStruct{
 		TimeoutInSecs: 0,
@@ -182,22 +194,150 @@ func startOpenGFW(ctxGFW context.Context, expName, gfwExecPath string) {
 			gfwExecPath + "/configs/config.yaml",
 			gfwExecPath + "/rules/ruleset.yaml",
 		},
-		StdoutFile: "OpenGFW." + expName + ".log",
-		StderrFile: "OpenGFW." + expName + ".err",
+		StdoutFile:  "OpenGFW." + expName + ".log",
+		StderrFile:  "OpenGFW." + expName + ".err",
+		Labels:      map[string]string{"exp": workspaceName(expName), "role": "opengfw", "app": "opengfw"},
+		Restart:     datamodel.RestartOnFailure,
+		MaxRestarts: maxRestarts,
 	}
 	log.Println("Starting OpenGFW")
-	if res := makeRequest(ctxGFW, "/runInBackground", startOpenGFWCommand); res != http.StatusOK {
+	gfwJob, res := runInBackground(ctxGFW, startOpenGFWCommand)
+	if res != http.StatusOK {
 		log.Fatal("could not start OpenGFW")
 	}
 	time.Sleep(2 * time.Second)
 
 	makeRequest(ctxGFW, "/jobs", nil)
+
+	return []datamodel.JsonJobStruct{gfwJob}
+}
+
+// runInBackground starts cmd on the server associated with ctx and returns
+// the job that the server created for it
+func runInBackground(ctx context.Context, cmd datamodel.JsonCommandStruct) (datamodel.JsonJobStruct, int) {
+	var job datamodel.JsonJobStruct
+	res := makeRequestWithResponse(ctx, "/runInBackground", cmd, &job)
+	if res == http.StatusOK && job.State == datamodel.JobPending {
+		log.Infof("holding job %d: %s", job.JobNo, job.CmdLine)
+	} else if res == http.StatusOK {
+		log.Infof("started job %d (pid %d): %s", job.JobNo, job.Pid, job.CmdLine)
+	}
+	return job, res
+}
+
+// logJobs logs how late the held jobs whose labels match selector started on
+// the server associated with ctx (or why they didn't), and warns about those
+// that have been restarted
+func logJobs(ctx context.Context, name, selector string) {
+	var jobs []datamodel.JsonJobStruct
+	if res := makeRequestWithResponse(ctx, "/jobs?state=all&selector="+url.QueryEscape(selector), nil, &jobs); res != http.StatusOK {
+		return
+	}
+	for _, job := range jobs {
+		switch {
+		case job.State == datamodel.JobFailed:
+			log.Warnf("%s: job %d (%s) failed to start: %s", name, job.JobNo, job.CmdLine, job.Error)
+		case job.State == datamodel.JobPending || job.State == datamodel.JobCanceled:
+			log.Warnf("%s: job %d (%s) hasn't started (%s)", name, job.JobNo, job.CmdLine, job.State)
+		case job.ScheduledAt != nil:
+			log.Infof("%s: job %d (%s) started %.3fs late", name, job.JobNo, job.CmdLine, job.StartSkewSecs)
+		}
+		if job.Restarts > 0 {
+			log.Warnf("%s: job %d (%s) %s", name, job.JobNo, job.CmdLine, describeRestarts(job))
+		}
+	}
+}
+
+// describeRestarts says how often a job has been restarted and, if it's
+// known, why it was last restarted. (A job that is always restarted needn't
+// have failed.)
+func describeRestarts(job datamodel.JsonJobStruct) string {
+	s := fmt.Sprintf("has been restarted %d times", job.Restarts)
+	if job.LastFailure != "" {
+		s += ", last after " + job.LastFailure
+	}
+	if job.LastFailureAt != nil {
+		s += " at " + job.LastFailureAt.Format(time.StampMilli)
+	}
+	return s
+}
+
+// jobLabels returns the labels of a job started for an iteration of the
+// experiment, by which it (and the rest of the experiment's jobs) can be
+// listed and killed.
+func jobLabels(expName, role, app string, transportType TransportType, configNum int) map[string]string {
+	return map[string]string{
+		"exp":       workspaceName(expName),
+		"role":      role,
+		"app":       app,
+		"transport": transportType.String(),
+		"iter":      strconv.Itoa(configNum),
+	}
+}
+
+// stopMatchingJobs kills the jobs whose labels match selector on the server
+// associated with ctx
+func stopMatchingJobs(ctx context.Context, selector string) {
+	log.Printf("stopping jobs matching %s", selector)
+	makeRequest(ctx, "/kill", datamodel.JsonKillStruct{Selector: &selector})
+}
+
+// stopJobs kills the given jobs on the server associated with ctx
+func stopJobs(ctx context.Context, jobs []datamodel.JsonJobStruct) {
+	for _, job := range jobs {
+		log.Printf("stopping job %d", job.JobNo)
+		makeRequest(ctx, "/kill", datamodel.JsonKillStruct{JobNo: job.JobNo})
+	}
+}
+
+// checkHost makes sure that the host of the server associated with ctx has
+// at least minDiskMB of free disk space (for the workspace) and minMemMB of
+// available memory, logging a summary of its state.
+func checkHost(ctx context.Context, name string, minDiskMB, minMemMB int64) error {
+	info, res := getSysInfo(ctx)
+	if res != http.StatusOK {
+		// e.g. an older server without /sysinfo
+		log.Warnf("cannot check %s: status code %d", name, res)
+		return nil
+	}
+	logHost(name, info)
+	if diskMB := info.Disk.AvailableBytes >> 20; diskMB < minDiskMB {
+		return fmt.Errorf("%s has only %d MB of disk free in %s (need %d MB)", name, diskMB, info.Disk.Path, minDiskMB)
+	}
+	if memMB := info.Memory.AvailableBytes >> 20; memMB < minMemMB {
+		return fmt.Errorf("%s has only %d MB of memory available (need %d MB)", name, memMB, minMemMB)
+	}
+	return nil
 }
 
-func stopAllJobs(ctxs []*context.Context) {
-	log.Println("stopping all jobs")
-	for _, ctx := range ctxs {
-		makeRequest(*ctx, "/kill", allJobs)
+// sampleHost logs the state of the host of the server associated with ctx.
+func sampleHost(ctx context.Context, name string) {
+	if info, res := getSysInfo(ctx); res == http.StatusOK {
+		logHost(name, info)
+	}
+}
+
+// logHost logs a one-line summary of a host's state.
+func logHost(name string, info datamodel.JsonSysInfoStruct) {
+	log.Infof("%s (%s, kernel %s, up %v): load %.2f %.2f %.2f on %d CPUs, %d/%d MB memory available, %d MB disk free in %s",
+		name, info.Hostname, info.KernelVersion, (time.Duration(info.UptimeSecs) * time.Second).Round(time.Second),
+		info.LoadAvg[0], info.LoadAvg[1], info.LoadAvg[2], info.NumCPU,
+		info.Memory.AvailableBytes>>20, info.Memory.TotalBytes>>20,
+		info.Disk.AvailableBytes>>20, info.Disk.Path)
+}
+
+// collectResults downloads a tarball of the files matching the glob patterns
+// from the server associated with ctx, saving it as name.tar.gz in
+// resultsDir. It does nothing if resultsDir is empty.
+func collectResults(ctx context.Context, globs []string, resultsDir, name string) {
+	if resultsDir == "" {
+		return
+	}
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := downloadArchive(ctx, globs, filepath.Join(resultsDir, name+".tar.gz")); err != nil {
+		log.Warn(err)
 	}
 }
 
@@ -212,29 +352,47 @@ func main() {
 		bridgeUrlEndpoint   string
 		ptAdapterPath       string
 		tgenPath            string
+		upgenPath           string
+		resultsDir          string
 		bridgeByIP          string
 		iterations          int
 		insecure            bool
+		clientCert          string
+		clientKey           string
+		caPath              string
+		signRequests        bool
+		minDiskMB           int64
+		minMemMB            int64
 		firewallOff         bool
+		launchDelay         time.Duration
+		clientLag           time.Duration
 	)
 	var ctxGFW, ctxCensoredVM, ctxBridge context.Context
 
 	authToken = os.Getenv("SERVER_AUTH_TOKEN")
-	if authToken == "" {
-		log.Fatal("SERVER_AUTH_TOKEN not set")
-	}
 
 	flag.StringVar(&expName, "exp", "", "experiment name")
+	flag.BoolVar(&signRequests, "sign", false, "Sign requests with HMAC (keyed by the auth token) rather than sending the token itself")
+	flag.StringVar(&clientCert, "client-cert", "", "Path to a client certificate to present to the servers (along with -client-key)")
+	flag.StringVar(&clientKey, "client-key", "", "Path to the client certificate's key")
+	flag.StringVar(&caPath, "ca", "", "Path to a PEM file of CA certificates to verify the servers with (default: the system's)")
 	flag.BoolVar(&insecure, "insecure", false, "Set to disable TLS verification (on all endpoints)")
 	flag.BoolVar(&firewallOff, "firewall_off", false, "Set to disable OpenGFW")
 	flag.StringVar(&gfwUrlEndpoint, "gfw_url", "", "Specify the URL endpoint for OpenGFW")
-	flag.StringVar(&gfwExecPath, "gfw_exec", "../../OpenGFW/", "Specify the path to OpenGFW")
+	flag.StringVar(&gfwExecPath, "gfw_exec", "../../../../OpenGFW/", "Specify the path to OpenGFW, relative to the OpenGFW server's default workspace")
 	flag.StringVar(&censoredUrlEndpoint, "censoredvm_url", "", "Specify the URL endpoint for censored VM")
 	flag.StringVar(&bridgeUrlEndpoint, "bridge_url", "", "Specify the URL endpoint for the bridge")
 	flag.StringVar(&bridgeByIP, "bridge_ip", "", "Bridge's IP address")
 	flag.StringVar(&ptAdapterPath, "ptadapter", "/usr/local/bin/ptadapter", "path to ptadapter on both bridge and censored VM")
 	flag.StringVar(&tgenPath, "tgen", "/usr/local/bin/tgen", "path to tgen on both bridge and censored VM")
+	flag.StringVar(&upgenPath, "upgen", "../../../../upgen", "path to upgen (proteus and its PSFs) on both bridge and censored VM, relative to the experiment's workspace")
 	flag.IntVar(&iterations, "iterations", 1000, "Number of iterations to run")
+	flag.Int64Var(&minDiskMB, "min-disk", 1024, "Minimum free disk space (in MB) for the bridge's and censored VM's workspaces before starting")
+	flag.Int64Var(&minMemMB, "min-mem", 256, "Minimum available memory (in MB) on every host before starting")
+	flag.DurationVar(&launchDelay, "launch-delay", 500*time.Millisecond, "How far ahead to schedule each iteration's start of tgen (once ptadapter is listening on the bridge and censored VM), so that both can be told in time")
+	flag.DurationVar(&clientLag, "client-lag", 500*time.Millisecond, "How long after tgen starts on the bridge to start it on the censored VM")
+	flag.IntVar(&maxRestarts, "max-restarts", maxRestarts, "How many times the server may restart OpenGFW or ptadapter if it crashes (0 for no limit)")
+	flag.StringVar(&resultsDir, "results", "", "Directory to download tarballs of the experiment's logs to (if set), e.g. results/2025-01-22-exp")
 	flag.Parse()
 
 	if expName == "" || gfwUrlEndpoint == "" || bridgeByIP == "" ||
@@ -243,16 +401,44 @@ func main() {
 		os.Exit(1)
 	}
 
+	if (clientCert == "") != (clientKey == "") {
+		log.Fatal("-client-cert and -client-key must be given together")
+	}
+	if authToken == "" && clientCert == "" {
+		log.Fatal("SERVER_AUTH_TOKEN not set (and no client certificate given)")
+	}
+	if authToken == "" && signRequests {
+		log.Fatal("SERVER_AUTH_TOKEN must be set to sign requests")
+	}
+
 	if insecure {
 		log.Println("Warning: Skipping TLS verification")
 	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure} // DANGER
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caPath != "" {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("%s: no certificates found", caPath)
+		}
+	}
 
 	tr := &http.Transport{
 		MaxIdleConns:        10,
 		IdleConnTimeout:     3 * time.Minute,
 		DisableCompression:  true,
 		TLSHandshakeTimeout: 5 * time.Second,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecure}, // DANGER
+		TLSClientConfig:     tlsConfig,
 	}
 	client := &http.Client{Transport: tr}
 	defer client.CloseIdleConnections()
@@ -260,17 +446,46 @@ func main() {
 	// create our contexts
 	ctxGFW = context.WithValue(context.Background(), AuthTokenKey, authToken)
 	ctxGFW = context.WithValue(ctxGFW, ClientKey, client)
+	ctxGFW = context.WithValue(ctxGFW, SignRequestsKey, signRequests)
 	ctxGFW = context.WithValue(ctxGFW, URLEndpointKey, gfwUrlEndpoint)
 	ctxCensoredVM = context.WithValue(ctxGFW, URLEndpointKey, censoredUrlEndpoint)
 	ctxBridge = context.WithValue(ctxGFW, URLEndpointKey, bridgeUrlEndpoint)
 
-	// make sure everything is shut down
-	stopAllJobs([]*context.Context{&ctxGFW, &ctxCensoredVM, &ctxBridge})
+	// the bridge and censored VM keep this experiment's files in a workspace
+	// of their own
+	ctxCensoredVM = context.WithValue(ctxCensoredVM, WorkspaceKey, workspaceName(expName))
+	ctxBridge = context.WithValue(ctxBridge, WorkspaceKey, workspaceName(expName))
+	for _, ctx := range []context.Context{ctxCensoredVM, ctxBridge} {
+		if res := createWorkspace(ctx); res != http.StatusOK {
+			log.Fatalf("could not create workspace %s", getWorkspace(ctx))
+		}
+	}
+
+	// make sure that the hosts are fit to run the experiment (OpenGFW
+	// doesn't use a workspace, so only its memory matters)
+	if err := checkHost(ctxGFW, "opengfw", 0, minMemMB); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkHost(ctxCensoredVM, "censored VM", minDiskMB, minMemMB); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkHost(ctxBridge, "bridge", minDiskMB, minMemMB); err != nil {
+		log.Fatal(err)
+	}
+
+	// make sure that nothing is left over from a previous run of this
+	// experiment (but leave other experiments' jobs alone). Only one OpenGFW
+	// can run at a time, though, whichever experiment started it.
+	experiment := "exp=" + workspaceName(expName)
+	stopMatchingJobs(ctxGFW, "role=opengfw")
+	stopMatchingJobs(ctxCensoredVM, experiment)
+	stopMatchingJobs(ctxBridge, experiment)
 	time.Sleep(2 * time.Second)
 
 	// start OpenGFW
+	var gfwJobs, bridgeJobs, clientJobs []datamodel.JsonJobStruct
 	if !firewallOff {
-		startOpenGFW(ctxGFW, expName, gfwExecPath)
+		gfwJobs = startOpenGFW(ctxGFW, expName, gfwExecPath)
 	}
 	time.Sleep(time.Second)
 
@@ -278,10 +493,13 @@ func main() {
 		for _, ttype := range []TransportType{obfsTransport, proteusTransport} {
 
 			log.Infof("Starting iteration %d with transport type %s", configNum, ttype)
+			sampleHost(ctxCensoredVM, "censored VM")
+			sampleHost(ctxBridge, "bridge")
 
-			// make sure bridge and client aren't doing anything
-			stopAllJobs([]*context.Context{&ctxCensoredVM, &ctxBridge})
-			time.Sleep(2 * time.Second)
+			// stop whatever the previous iteration started on the bridge and
+			// client (the server waits for the jobs to exit)
+			stopMatchingJobs(ctxCensoredVM, experiment)
+			stopMatchingJobs(ctxBridge, experiment)
 
 			// notify opengfw of our configuration
 			digCmd := datamodel.JsonCommandStruct{
@@ -298,18 +516,38 @@ func main() {
 			}
 			makeRequest(ctxCensoredVM, "/runToCompletion", digCmd)
 
-			// start ptadapter and tgen on the bridge
-			startBridge(ctxBridge, ttype, configNum, expName, tgenPath, ptAdapterPath)
-
-			// start tgen and ptadapter on the censored VM
-			startClient(ctxCensoredVM, ttype, configNum, expName, tgenPath, ptAdapterPath, bridgeByIP)
+			// start ptadapter on the bridge and then the censored VM (the
+			// servers respond once it's listening), and then have them start
+			// tgen at coordinated instants (which relies on their clocks
+			// being synchronized)
+			bridgePT := startBridge(ctxBridge, ttype, configNum, expName, ptAdapterPath, upgenPath)
+			clientPT := startClient(ctxCensoredVM, ttype, configNum, expName, ptAdapterPath, upgenPath, bridgeByIP)
+			tgenStart := time.Now().Add(launchDelay)
+			bridgeJobs = []datamodel.JsonJobStruct{bridgePT, startTgen(ctxBridge, "bridge", ttype, configNum, expName, tgenPath, "server.tgen.graphml", tgenStart)}
+			clientJobs = []datamodel.JsonJobStruct{clientPT, startTgen(ctxCensoredVM, "client", ttype, configNum, expName, tgenPath, "client.tgen.graphml", tgenStart.Add(clientLag))}
+
+			// let tgen run for a while before the next iteration
+			time.Sleep(time.Until(tgenStart.Add(clientLag)) + 3500*time.Millisecond)
+			iteration := fmt.Sprintf("exp=%s,transport=%v,iter=%d", workspaceName(expName), ttype, configNum)
+			logJobs(ctxBridge, "bridge", iteration)
+			logJobs(ctxCensoredVM, "censored VM", iteration)
+			if !firewallOff {
+				logJobs(ctxGFW, "opengfw", "role=opengfw")
+			}
 
 		}
 	}
 
 	time.Sleep(60 * time.Second)
 	log.Println("Killing all jobs")
-	makeRequest(ctxCensoredVM, "/kill", allJobs)
-	makeRequest(ctxGFW, "/kill", allJobs)
-	makeRequest(ctxBridge, "/kill", allJobs)
+	stopJobs(ctxCensoredVM, clientJobs)
+	stopJobs(ctxGFW, gfwJobs)
+	stopJobs(ctxBridge, bridgeJobs)
+
+	// the bridge and censored VM have a workspace for this experiment, but
+	// OpenGFW's files are alongside those of other experiments
+	logGlobs := []string{"tgen.*", "ptadapter.*"}
+	collectResults(ctxCensoredVM, logGlobs, resultsDir, "censored")
+	collectResults(ctxGFW, []string{"OpenGFW." + expName + ".*"}, resultsDir, "opengfw")
+	collectResults(ctxBridge, logGlobs, resultsDir, "bridge")
 }
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeRestarts(t *testing.T) {
+	at := time.Date(2025, 1, 22, 10, 30, 0, 0, time.Local)
+	assert.Equal(t, "has been restarted 2 times, last after exit code 1 at Jan 22 10:30:00.000",
+		describeRestarts(datamodel.JsonJobStruct{Restarts: 2, LastFailure: "exit code 1", LastFailureAt: &at}))
+	// (a job that is always restarted may not have failed)
+	assert.Equal(t, "has been restarted 3 times",
+		describeRestarts(datamodel.JsonJobStruct{Restarts: 3}))
+}
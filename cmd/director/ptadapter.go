@@ -33,6 +33,10 @@ var ptAdapterProteusServerTemplateBytes []byte
 
 const startingPortNum = 8080
 
+// clientListenPort is the port that ptadapter listens on on the censored VM
+// (as in the client templates), for tgen to connect to
+const clientListenPort = 9999
+
 func getObsCertificates(configNum int) FileMap {
 
 	pattern := fmt.Sprintf("state.%d/*", configNum)
@@ -133,7 +137,7 @@ func getObfsPTAdapterClientTemplate(certBytes []byte, bridgeHostname string, ite
 	return parsedTemplate.Bytes()
 }
 
-func getProteusPTAdapterServerTemplate(optionString string, iterationNum int) []byte {
+func getProteusPTAdapterServerTemplate(upgenPath, optionString string, iterationNum int) []byte {
 
 	tmpl, err := template.New("proteusServerTemplate").Parse(string(ptAdapterProteusServerTemplateBytes))
 	if err != nil {
@@ -143,9 +147,11 @@ func getProteusPTAdapterServerTemplate(optionString string, iterationNum int) []
 	var parsedTemplate bytes.Buffer
 	err = tmpl.Execute(&parsedTemplate,
 		struct {
+			UpgenPath  string
 			Options    string
 			ListenPort int
 		}{
+			UpgenPath:  upgenPath,
 			Options:    optionString,
 			ListenPort: iterationNum + startingPortNum,
 		})
@@ -156,7 +162,7 @@ func getProteusPTAdapterServerTemplate(optionString string, iterationNum int) []
 	return parsedTemplate.Bytes()
 }
 
-func getProteusPTAdapterClientTemplate(optionString, bridgeHostname string, iterationNum int) []byte {
+func getProteusPTAdapterClientTemplate(upgenPath, optionString, bridgeHostname string, iterationNum int) []byte {
 	tmpl, err := template.New("proteusClientTemplate").Parse(string(ptAdapterProteusClientTemplateBytes))
 	if err != nil {
 		log.Fatal(err)
@@ -165,11 +171,13 @@ func getProteusPTAdapterClientTemplate(optionString, bridgeHostname string, iter
 	var parsedTemplate bytes.Buffer
 	err = tmpl.Execute(&parsedTemplate,
 		struct {
-			Server  string
-			Options string
+			UpgenPath string
+			Server    string
+			Options   string
 		}{
-			Server:  fmt.Sprintf("%s:%d", bridgeHostname, iterationNum+startingPortNum),
-			Options: optionString,
+			UpgenPath: upgenPath,
+			Server:    fmt.Sprintf("%s:%d", bridgeHostname, iterationNum+startingPortNum),
+			Options:   optionString,
 		})
 	if err != nil {
 		log.Fatal(err)
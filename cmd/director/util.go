@@ -3,44 +3,64 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"datamodel"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode"
 )
 
 func makeRequest(ctx context.Context, f string, data any) int {
+	return makeRequestWithResponse(ctx, f, data, nil)
+}
+
+// makeRequestWithResponse is like makeRequest, but additionally decodes a
+// successful JSON response into v (unless v is nil).
+func makeRequestWithResponse(ctx context.Context, f string, data any, v any) int {
+	return makeRequestWithMethod(ctx, http.MethodGet, f, data, v)
+}
+
+// makeRequestWithMethod is like makeRequestWithResponse, but uses the given
+// HTTP method rather than GET.
+func makeRequestWithMethod(ctx context.Context, method string, f string, data any, v any) int {
 	var err error
 	var req *http.Request
 
 	url := ctx.Value(URLEndpointKey).(string)
 
+	var j []byte
 	if data != nil {
-		var j []byte
 		j, err = json.Marshal(data)
 		if err != nil {
 			log.Fatal(err)
 		}
-		req, err = http.NewRequest("GET", url+f, bytes.NewBuffer(j))
+		req, err = http.NewRequest(method, url+f, bytes.NewBuffer(j))
 	} else {
-		req, err = http.NewRequest("GET", url+f, nil)
+		req, err = http.NewRequest(method, url+f, nil)
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	client := ctx.Value(ClientKey).(*http.Client)
-	token := ctx.Value(AuthTokenKey).(string)
-	req.Header = http.Header{
-		"X-Session-Token": {token},
-		"Content-Type":    {"application/json"},
-	}
+	req.Header.Set("Content-Type", "application/json")
+	authorizeRequest(ctx, req, j)
 	log.Printf("Making request to %v: %v\n", url+f, data)
 	res, err := client.Do(req)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer res.Body.Close()
 	if res.StatusCode == http.StatusOK {
 		b, err := io.ReadAll(res.Body)
 		if err != nil {
@@ -48,15 +68,22 @@ func makeRequest(ctx context.Context, f string, data any) int {
 		}
 		fmt.Printf("Response from %s%s:\n\n", url, f)
 		fmt.Println(string(b))
+		if v != nil {
+			if err = json.Unmarshal(b, v); err != nil {
+				log.Fatal(err)
+			}
+		}
 	} else {
-		log.Printf("Unexpected status code from %s%s: %d", url, f, res.StatusCode)
+		// (the body says what went wrong, e.g. with a job's output if it
+		// didn't become ready)
+		b, _ := io.ReadAll(res.Body)
+		log.Printf("Unexpected status code from %s%s: %d: %s", url, f, res.StatusCode, b)
 	}
 	return res.StatusCode
 }
 
 func sendFile(ctx context.Context, fileName string, fileContents []byte) int {
 	client := ctx.Value(ClientKey).(*http.Client)
-	token := ctx.Value(AuthTokenKey).(string)
 	url := ctx.Value(URLEndpointKey).(string)
 
 	body := &bytes.Buffer{}
@@ -71,6 +98,12 @@ func sendFile(ctx context.Context, fileName string, fileContents []byte) int {
 		log.Fatal(err)
 	}
 
+	if workspace := getWorkspace(ctx); workspace != "" {
+		if err = writer.WriteField("workspace", workspace); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if err = writer.Close(); err != nil {
 		log.Fatal(err)
 	}
@@ -81,7 +114,7 @@ func sendFile(ctx context.Context, fileName string, fileContents []byte) int {
 	}
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("X-Session-Token", token)
+	authorizeRequest(ctx, req, body.Bytes())
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -95,3 +128,118 @@ func sendFile(ctx context.Context, fileName string, fileContents []byte) int {
 	}
 	return resp.StatusCode
 }
+
+// authorizeRequest adds the headers that authenticate a request to the server
+// associated with ctx: either the token itself or, if requests are to be
+// signed, an HMAC signature keyed by it (see datamodel.SignRequest). body must
+// be the request's body. Without a token, the client certificate (if any) is
+// all that identifies us.
+func authorizeRequest(ctx context.Context, req *http.Request, body []byte) {
+	token := ctx.Value(AuthTokenKey).(string)
+	if token == "" {
+		return
+	}
+	if sign, _ := ctx.Value(SignRequestsKey).(bool); !sign {
+		req.Header.Set("X-Session-Token", token)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(datamodel.TimestampHeader, timestamp)
+	req.Header.Set(datamodel.NonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(datamodel.SignatureHeader, datamodel.SignRequest([]byte(token),
+		req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), body))
+}
+
+// getWorkspace returns the name of the workspace that commands and files
+// should use on the server associated with ctx, or "" if there is none.
+func getWorkspace(ctx context.Context) string {
+	workspace, _ := ctx.Value(WorkspaceKey).(string)
+	return workspace
+}
+
+// createWorkspace creates the workspace associated with ctx on its server.
+func createWorkspace(ctx context.Context) int {
+	return makeRequestWithMethod(ctx, http.MethodPut, "/workspaces/"+getWorkspace(ctx), nil, nil)
+}
+
+// getSysInfo describes the host of the server associated with ctx,
+// including the free space of its workspace (if any).
+func getSysInfo(ctx context.Context) (datamodel.JsonSysInfoStruct, int) {
+	var info datamodel.JsonSysInfoStruct
+	f := "/sysinfo"
+	if workspace := getWorkspace(ctx); workspace != "" {
+		f += "?" + url.Values{"workspace": {workspace}}.Encode()
+	}
+	res := makeRequestWithResponse(ctx, f, nil, &info)
+	return info, res
+}
+
+// workspaceName turns an experiment name into a valid workspace name.
+func workspaceName(expName string) string {
+	name := regexp.MustCompile(`[^A-Za-z0-9._-]`).ReplaceAllString(expName, "_")
+	if name == "" || !unicode.IsLetter(rune(name[0])) && !unicode.IsDigit(rune(name[0])) {
+		name = "exp" + name
+	}
+	return name
+}
+
+// downloadArchive fetches a gzip-compressed tarball of the files matching
+// the glob patterns (relative to the workspace associated with ctx) from the
+// server, and saves it as dest.
+func downloadArchive(ctx context.Context, globs []string, dest string) error {
+	return fetchToFile(ctx, "/archive", url.Values{"glob": globs}, dest)
+}
+
+// fetchToFile makes a GET request to endpoint f with the given query (plus
+// the workspace associated with ctx, if any), and saves the response body as
+// dest. The body is checked against the SHA-256 hash sent by the server in
+// the X-Content-SHA256 header or trailer.
+func fetchToFile(ctx context.Context, f string, query url.Values, dest string) error {
+	client := ctx.Value(ClientKey).(*http.Client)
+	baseUrl := ctx.Value(URLEndpointKey).(string)
+
+	if workspace := getWorkspace(ctx); workspace != "" {
+		query.Set("workspace", workspace)
+	}
+	req, err := http.NewRequest(http.MethodGet, baseUrl+f+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	authorizeRequest(ctx, req, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch %s%s: status code %v", baseUrl, f, resp.Status)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	// the trailer is only available once the body has been read
+	expected := resp.Header.Get("X-Content-SHA256")
+	if expected == "" {
+		expected = resp.Trailer.Get("X-Content-SHA256")
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != expected {
+		os.Remove(dest)
+		return fmt.Errorf("checksum mismatch fetching %s%s", baseUrl, f)
+	}
+	log.Printf("fetched %s%s to %s\n", baseUrl, f, dest)
+	return nil
+}
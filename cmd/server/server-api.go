@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"datamodel"
@@ -18,25 +24,19 @@ import (
 
 // HTTP Handlers
 
-// handleVersion handles the "/version" endpoint and returns the server version.
+// handleVersion handles the "/version" endpoint and returns the server version,
+// and when its certificate expires.
 func handleVersion(w http.ResponseWriter, r *http.Request) {
 	res := struct {
-		Version string `json:"version"`
+		Version     string                           `json:"version"`
+		Certificate *datamodel.JsonCertificateStruct `json:"certificate,omitempty"`
 	}{
-		Version: version,
+		Version:     version,
+		Certificate: certificates.describe(),
 	}
 	writeJson(res, w)
 }
 
-// handleExit handles the "/exit" endpoint and exits the server after a delay.
-func handleExit(w http.ResponseWriter, r *http.Request) {
-	writeJson(true, w)
-	go func() {
-		time.Sleep(1 * time.Second)
-		os.Exit(0)
-	}()
-}
-
 // handleRunToCompletion handles the "/runToCompletion" endpoint and executes a command synchronously.
 func handleRunToCompletion(w http.ResponseWriter, r *http.Request) {
 	var cmdFromForm datamodel.JsonCommandStruct
@@ -49,16 +49,61 @@ func handleRunToCompletion(w http.ResponseWriter, r *http.Request) {
 	var output []byte
 	var err error
 
+	ctx := context.Background()
 	if cmdFromForm.TimeoutInSecs > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cmdFromForm.TimeoutInSecs)*time.Second)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, secondsToDuration(cmdFromForm.TimeoutInSecs))
 		defer cancel()
-
-		cmd = exec.CommandContext(ctx, cmdFromForm.Cmd, cmdFromForm.Args...)
-	} else {
-		cmd = exec.Command(cmdFromForm.Cmd, cmdFromForm.Args...)
 	}
-	if output, err = cmd.Output(); err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
+	cmd = exec.CommandContext(ctx, cmdFromForm.Cmd, cmdFromForm.Args...)
+	if _, err = setupCommand(cmd, cmdFromForm); err != nil {
+		writeSetupError(w, err)
+		return
+	}
+	if err = commandPolicy.check("/runToCompletion", cmd, cmdFromForm); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err = createWorkingDir(cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cgroup, cgroupDir, err := setupCgroup(cmd, "run-"+getRequestInfo(r).id, cmdFromForm.Resources)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// on timeout, kill the command along with any children it spawned
+	cmd.Cancel = func() error {
+		if cgroup != "" {
+			killCgroup(cgroup, syscall.SIGTERM, defaultKillGrace)
+		} else {
+			killProcessGroup(cmd.Process.Pid, syscall.SIGTERM, defaultKillGrace)
+		}
+		return nil
+	}
+	var stdout bytes.Buffer
+	var usage *datamodel.JsonUsageStruct
+	cmd.Stdout = &stdout
+	err = runPrivileged(cmd.Start)
+	closeFiles(cgroupDir)
+	if err == nil {
+		startTime := time.Now()
+		info := getRequestInfo(r)
+		auditStart(info.id, info.identityName(), cmd, cmdFromForm, nil)
+		recordJobStart("/runToCompletion")
+		err = cmd.Wait()
+		exit := exitStatus(cmd.ProcessState)
+		auditExit(info.id, nil, cmd.Process.Pid, exit)
+		recordJobExit("/runToCompletion", exit, time.Since(startTime))
+	}
+	if cgroup != "" {
+		usage = cgroupUsage(cgroup)
+		removeCgroup(cgroup)
+	}
+	output = stdout.Bytes()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
 			http.Error(w, "timeout", http.StatusRequestTimeout)
 			return
 		} else {
@@ -67,32 +112,271 @@ func handleRunToCompletion(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	writeJson(struct {
-		Success  bool   `json:"success"`
-		Output   string `json:"output"`
-		ExitCode int    `json:"exitCode"`
+		Success  bool                       `json:"success"`
+		Output   string                     `json:"output"`
+		ExitCode int                        `json:"exitCode"`
+		Usage    *datamodel.JsonUsageStruct `json:"usage,omitempty"`
 	}{
 		Success:  true,
 		Output:   string(output),
 		ExitCode: cmd.ProcessState.ExitCode(),
+		Usage:    usage,
 	}, w)
 }
 
-func writeToFile(wg *sync.WaitGroup, fileName string, s *io.ReadCloser) {
-	defer wg.Done()
-	wg.Add(1)
-	file, err := os.Create(fileName)
+// setupCommand sets the working directory, environment and user of cmd, as
+// requested by the client. The working directory is confined to the
+// command's workspace, whose directory is returned; it isn't created here,
+// since the command has yet to pass the policy check (see
+// createWorkingDir). The command is also put in a process group of its own,
+// so that it can be killed along with any children it spawns.
+func setupCommand(cmd *exec.Cmd, c datamodel.JsonCommandStruct) (string, error) {
+	if err := checkResources(c.Resources); err != nil {
+		return "", err
+	}
+	if err := checkLabels(c.Labels); err != nil {
+		return "", err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if c.User != "" && c.User != serverUser {
+		cred, err := lookupCredential(c.User)
+		if err != nil {
+			return "", fmt.Errorf("invalid user %q: %v", c.User, err)
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+	root, err := workspaceDir(c.Workspace)
 	if err != nil {
-		log.Printf("warning: cannot create file (%v): %v\n", fileName, err)
-		return
+		return "", err
 	}
-	defer file.Close()
-	_, err = io.Copy(file, *s)
+	if cmd.Dir, err = resolveInWorkspace(root, root, c.Cwd); err != nil {
+		return "", err
+	}
+
+	// a nil Env means that the server's environment is inherited
+	if len(c.Env) == 0 && !c.ClearEnv {
+		return root, nil
+	}
+	env := []string{}
+	if !c.ClearEnv {
+		env = os.Environ()
+	}
+	// sort the keys, so that the environment is deterministic. (Later
+	// entries override earlier ones.)
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return "", fmt.Errorf("invalid environment variable name %q", k)
+		}
+		env = append(env, k+"="+c.Env[k])
+	}
+	cmd.Env = env
+	return root, nil
+}
+
+// createWorkingDir creates the working directory of a command that has been
+// set up (see setupCommand), if necessary. It must only be called once the
+// command has passed the policy check.
+func createWorkingDir(cmd *exec.Cmd) error {
+	return os.MkdirAll(cmd.Dir, 0755)
+}
+
+// writeSetupError reports an error from setting up a command or resolving a
+// path in a workspace.
+func writeSetupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoSuchWorkspace) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// outputPollInterval is how often we check a job's output files for more
+// output, to copy to its ring buffers
+const outputPollInterval = 100 * time.Millisecond
+
+// createOutput creates the destination for one of a job's output streams. If
+// fileName is empty, the job writes to its ring buffer rb, through a pipe
+// (which means that the job can't outlive the server: once the server has
+// gone, its next write kills it with SIGPIPE). Otherwise the job writes
+// straight to the file, which is appended to if appendFile is set, and its
+// output is copied to rb from there (see followOutput). It returns what the
+// job should write to, and a function to call once the job has exited (or
+// failed to start).
+func createOutput(rb *datamodel.RingBuffer, fileName string, appendFile bool) (io.Writer, func(), error) {
+	if fileName == "" {
+		return rb, func() {}, nil
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendFile {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(fileName, flags, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	// (the job writes from the end of the file)
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	stop, err := followOutput(fileName, offset, rb)
 	if err != nil {
-		log.Printf("warning: cannot write to file (%v): %v\n", fileName, err)
+		file.Close()
+		return nil, nil, err
 	}
+	return file, func() {
+		stop()
+		file.Close()
+	}, nil
+}
+
+// followOutput copies what is written to a job's output file, from offset
+// onwards, to the job's ring buffer rb (checking for more every
+// outputPollInterval). It returns a function that stops following the file,
+// once everything written to it so far has been copied.
+func followOutput(fileName string, offset int64, rb *datamodel.RingBuffer) (func(), error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer f.Close()
+		ticker := time.NewTicker(outputPollInterval)
+		defer ticker.Stop()
+		for {
+			io.Copy(rb, f)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				io.Copy(rb, f)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}, nil
 }
 
-// handleRunInBackground handles the "/runInBackground" endpoint and executes a command asynchronously.
+// startJob starts a background job's process, whose command (with its output
+// files already resolved) is p.Command. It returns a function that must be
+// called once the jobManager knows about the job, which enforces the job's
+// timeout and reports its exit to the jobManager. When a job is restarted,
+// its output is appended to its output files.
+// Note: once the job has been handed to the jobManager, only the jobManager
+// may start it (see holdJob).
+func startJob(p *datamodel.ProcessJobStruct) (func(), error) {
+	c := p.Command
+	cmd := exec.Command(c.Cmd, c.Args...)
+	if _, err := setupCommand(cmd, c); err != nil {
+		return nil, err
+	}
+	// (the command passed the policy check when it was requested)
+	if err := createWorkingDir(cmd); err != nil {
+		return nil, err
+	}
+
+	// send stdout and stderr to ring buffers, and to files if requested
+	stdout, stdoutDone, err := createOutput(p.Stdout, c.StdoutFile, p.Restarts > 0)
+	if err != nil {
+		return nil, err
+	}
+	stderr, stderrDone, err := createOutput(p.Stderr, c.StderrFile, p.Restarts > 0)
+	if err != nil {
+		stdoutDone()
+		return nil, err
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// put the job in its own cgroup, if we're using them (a new one each
+	// time that it's restarted, in case the last one is still in use)
+	cgroupName := fmt.Sprintf("job-%d", p.JobNo)
+	if p.Restarts > 0 {
+		cgroupName += fmt.Sprintf(".%d", p.Restarts)
+	}
+	cgroup, cgroupDir, err := setupCgroup(cmd, cgroupName, c.Resources)
+	if err != nil {
+		stdoutDone()
+		stderrDone()
+		return nil, err
+	}
+
+	// run the thing, in the background
+	err = runPrivileged(cmd.Start)
+	closeFiles(cgroupDir)
+	if err != nil {
+		stdoutDone()
+		stderrDone()
+		if cgroup != "" {
+			removeCgroup(cgroup)
+		}
+		return nil, err
+	}
+	p.Cmd = cmd
+	p.Pid = cmd.Process.Pid
+	p.StartTime = time.Now()
+	// (to recognize the process if the server restarts)
+	p.StartTicks, _ = processStartTicks(p.Pid)
+	p.Cgroup = cgroup
+	p.State = datamodel.JobRunning
+	p.Exit = nil
+	p.Usage = nil
+	// (once restarted, an adopted job is our child)
+	p.Adopted = false
+	if p.ScheduledAt != nil {
+		p.StartSkewSecs = p.StartTime.Sub(*p.ScheduledAt).Seconds()
+	}
+	if c.TimeoutInSecs > 0 {
+		p.Deadline = p.StartTime.Add(secondsToDuration(c.TimeoutInSecs))
+	}
+	select {
+	case <-p.Started:
+		// it's being restarted
+	default:
+		close(p.Started)
+	}
+	jobNo := p.JobNo
+	auditStart(p.RequestID, p.Identity, cmd, c, &jobNo)
+	recordJobStart("/runInBackground")
+
+	return func() {
+		if c.TimeoutInSecs > 0 {
+			time.AfterFunc(secondsToDuration(c.TimeoutInSecs), func() {
+				jobTimeoutChannel <- jobNo
+			})
+		}
+
+		// call wait on the thing we just started
+		go func() {
+			// Wait also waits for the job's output to be copied (if it
+			// writes to a pipe)
+			cmd.Wait()
+			stdoutDone()
+			stderrDone()
+			jobExitChannel <- p
+		}()
+	}, nil
+}
+
+// handleRunInBackground handles the "/runInBackground" endpoint and executes a
+// command asynchronously. If the command has a start time or a job to start
+// after, the job is held (as pending) until then, and started by holdJob. If it
+// has readiness conditions, the response waits until the job is ready (see
+// waitUntilReady); if it doesn't become ready, it's killed.
 func handleRunInBackground(w http.ResponseWriter, r *http.Request) {
 	var cmdFromForm datamodel.JsonCommandStruct
 	if err := json.NewDecoder(r.Body).Decode(&cmdFromForm); err != nil {
@@ -100,85 +384,158 @@ func handleRunInBackground(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var cmd *exec.Cmd
-	var err error
-	var stdout, stderr io.ReadCloser
+	// the job is listed under the workspace it actually runs in, so that the
+	// workspace can't be deleted while the job is running
+	if cmdFromForm.Workspace == "" {
+		cmdFromForm.Workspace = defaultWorkspace
+	}
 
-	if cmdFromForm.TimeoutInSecs > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cmdFromForm.TimeoutInSecs)*time.Second)
-		defer cancel()
+	// Note: the timeout (if any) is enforced by the jobManager once the job
+	// has started, since the job outlives this request
+	cmd := exec.Command(cmdFromForm.Cmd, cmdFromForm.Args...)
+	root, err := setupCommand(cmd, cmdFromForm)
+	if err != nil {
+		writeSetupError(w, err)
+		return
+	}
+	if err = commandPolicy.check("/runInBackground", cmd, cmdFromForm); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err = checkRestartPolicy(cmdFromForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cwd := cmd.Dir
 
-		cmd = exec.CommandContext(ctx, cmdFromForm.Cmd, cmdFromForm.Args...)
-	} else {
-		cmd = exec.Command(cmdFromForm.Cmd, cmdFromForm.Args...)
+	// resolve the output files (relative to the job's working directory, but
+	// inside its workspace) now, so that we can report where they ended up
+	for _, fileName := range []*string{&cmdFromForm.StdoutFile, &cmdFromForm.StderrFile} {
+		if *fileName == "" {
+			continue
+		}
+		if *fileName, err = resolveInWorkspace(root, cwd, *fileName); err != nil {
+			writeSetupError(w, err)
+			return
+		}
 	}
 
-	// create pipes for stderr and stdout
-	if cmdFromForm.StdoutFile != "" {
-		stdout, err = cmd.StdoutPipe()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	var rc *readyCondition
+	if cmdFromForm.ReadyWhen != nil {
+		if cmdFromForm.StartAt != nil || cmdFromForm.StartAfterJob != nil {
+			http.Error(w, "readyWhen can't be combined with startAt or startAfterJob", http.StatusBadRequest)
+			return
+		}
+		if rc, err = newReadyCondition(*cmdFromForm.ReadyWhen, root, cwd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		cmdFromForm.ReadyWhen = &rc.JsonReadyWhenStruct
 	}
-	if cmdFromForm.StderrFile != "" {
-		stderr, err = cmd.StderrPipe()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	var after *datamodel.ProcessJobStruct
+	if cmdFromForm.StartAfterJob != nil {
+		if after, err = lookupDependency(*cmdFromForm.StartAfterJob); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
 	}
 
-	// run the thing, in the background
-	if err = cmd.Start(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	info := getRequestInfo(r)
+	job := &datamodel.ProcessJobStruct{
+		Stdout:    datamodel.NewRingBuffer(ringBufferSize),
+		Stderr:    datamodel.NewRingBuffer(ringBufferSize),
+		RequestID: info.id,
+		Identity:  info.identityName(),
+		Command:   cmdFromForm,
+		Started:   make(chan struct{}),
+		Done:      make(chan struct{}),
+		JsonJobStruct: datamodel.JsonJobStruct{
+			JobNo:      <-jobChannel,
+			CmdLine:    cmdFromForm.Cmd + " " + strings.Join(cmdFromForm.Args, " "),
+			Workspace:  cmdFromForm.Workspace,
+			User:       cmdFromForm.User,
+			Cwd:        cwd,
+			StdoutFile: cmdFromForm.StdoutFile,
+			StderrFile: cmdFromForm.StderrFile,
+			State:      datamodel.JobPending,
+			Labels:     cmdFromForm.Labels,
+		},
+	}
+	if cmdFromForm.StartAt != nil || after != nil {
+		// take a copy of the job's description before the jobManager can
+		// update it
+		res := job.JsonJobStruct
+		processChannel <- job
+		go holdJob(job, after)
+		writeJson(res, w)
 		return
 	}
 
-	// call wait on the thing we just started
-	go func() {
-
-		// first, save stdout and stderr to files, if necessary
-		pipePointers := []struct {
-			fileName string
-			src      *io.ReadCloser
-		}{
-			{cmdFromForm.StdoutFile, &stdout},
-			{cmdFromForm.StderrFile, &stderr},
-		}
-		var wg sync.WaitGroup
-		for _, pipePointer := range pipePointers {
-			if pipePointer.fileName != "" {
-				// writeToFile adds 1 to wg
-				go writeToFile(&wg, pipePointer.fileName, pipePointer.src)
-			}
+	watch, err := startJob(job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, startTicks := job.JsonJobStruct, job.StartTicks
+	processChannel <- job
+	watch()
+	if rc != nil {
+		if err = waitUntilReady(job, rc, res.Pid, startTicks); err != nil {
+			http.Error(w, abandonJob(job, err).Error(), http.StatusInternalServerError)
+			return
 		}
-		// wait for stderr and stdout to finish writing
-		wg.Wait()
-
-		// finally, wait for the process to finish (which is should have already)
-		cmd.Wait()
-	}()
+	}
+	writeJson(res, w)
+}
 
-	processChannel <- &datamodel.ProcessJobStruct{
-		Cmd:        cmd,
-		JobNo:      <-jobChannel,
-		CmdLine:    cmdFromForm.Cmd + " " + strings.Join(cmdFromForm.Args, " "),
-		StdoutFile: cmdFromForm.StdoutFile,
-		StderrFile: cmdFromForm.StderrFile,
+// closeFiles closes the given files, ignoring nils.
+func closeFiles(files ...*os.File) {
+	for _, file := range files {
+		if file != nil {
+			file.Close()
+		}
 	}
-	writeJson(true, w)
 }
 
-// handleJobList handles the "/jobs" endpoint and returns the list of running jobs.
+// handleJobList handles the "/jobs" endpoint and returns the list of jobs. The
+// optional "state" query parameter selects running (the default), exited or
+// all jobs, and the optional "selector" parameter selects jobs by their labels
+// (see parseSelector).
 func handleJobList(w http.ResponseWriter, r *http.Request) {
-	jobListRequestChannel <- nil
-	jobList := <-jobListResponseChannel
+	filter := jobStateFilter(r.URL.Query().Get("state"))
+	switch filter {
+	case "":
+		filter = filterRunning
+	case filterRunning, filterExited, filterAll:
+	default:
+		http.Error(w, "state must be one of running, exited or all", http.StatusBadRequest)
+		return
+	}
+
+	sel, err := parseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobListRequestChannel <- filter
+	jobList := make(jobList, 0)
+	for _, job := range <-jobListResponseChannel {
+		if !sel.matches(job.Labels) {
+			continue
+		}
+		if job.State == datamodel.JobRunning && job.Cgroup != "" {
+			job.Usage = cgroupUsage(job.Cgroup)
+		}
+		jobList = append(jobList, job)
+	}
 
 	writeJson(jobList, w)
 }
 
-// handleJobList handles the "/jobs" endpoint and returns the list of running jobs.
+// handleKillJob handles the "/kill" endpoint and kills a job (or all jobs, or
+// those whose labels match a selector).
 func handleKillJob(w http.ResponseWriter, r *http.Request) {
 	var jsonKill datamodel.JsonKillStruct
 	if err := json.NewDecoder(r.Body).Decode(&jsonKill); err != nil {
@@ -186,8 +543,32 @@ func handleKillJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jobKillChannel <- jsonKill.JobNo
-	writeJson(true, w)
+	sig, err := parseSignal(jsonKill.Signal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	grace := defaultKillGrace
+	if jsonKill.GraceInSecs > 0 {
+		grace = secondsToDuration(jsonKill.GraceInSecs)
+	}
+
+	match := jobNumbered(jsonKill.JobNo)
+	if jsonKill.Selector != nil {
+		// (the empty selector would match every job)
+		if strings.TrimSpace(*jsonKill.Selector) == "" {
+			http.Error(w, "selector must not be empty (to kill every job, use job -1)", http.StatusBadRequest)
+			return
+		}
+		sel, err := parseSelector(*jsonKill.Selector)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		match = func(p *datamodel.ProcessJobStruct) bool { return sel.matches(p.Labels) }
+	}
+
+	writeJson(killJobs(match, sig, grace), w)
 }
 
 func handleUploadFile(w http.ResponseWriter, r *http.Request) {
@@ -212,8 +593,30 @@ func handleUploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	// Work out where the file should go: the "path" form value (which may
+	// include subdirectories) or else the uploaded file's name, relative to
+	// the workspace
+	workspace := r.FormValue("workspace")
+	root, err := workspaceDir(workspace)
+	if err != nil {
+		writeSetupError(w, err)
+		return
+	}
+	dstPath := r.FormValue("path")
+	if dstPath == "" {
+		dstPath = handler.Filename
+	}
+	if dstPath, err = resolveInWorkspace(root, root, dstPath); err != nil {
+		writeSetupError(w, err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		http.Error(w, "Failed to create directory on server", http.StatusInternalServerError)
+		return
+	}
+
 	// Create a new file on the server to store the uploaded file
-	dst, err := os.Create(handler.Filename)
+	dst, err := os.Create(dstPath)
 	if err != nil {
 		http.Error(w, "Failed to create file on server", http.StatusInternalServerError)
 		return
@@ -221,11 +624,68 @@ func handleUploadFile(w http.ResponseWriter, r *http.Request) {
 	defer dst.Close()
 
 	// Copy the contents of the uploaded file to the destination file
-	_, err = io.Copy(dst, file)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), file)
 	if err != nil {
 		http.Error(w, "Failed to copy file contents", http.StatusInternalServerError)
 		return
 	}
+	auditUpload(r, workspace, dstPath, size, hex.EncodeToString(hash.Sum(nil)))
+	uploadBytesMetric.add(float64(size))
 
 	writeJson(true, w)
 }
+
+// handleDownloadFile handles the "/download" endpoint and sends back the file
+// named by the "path" query parameter, relative to the (optional) "workspace".
+// Range requests are supported, and the SHA-256 hash of the whole file is
+// sent in the X-Content-SHA256 header.
+func handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	root, err := workspaceDir(query.Get("workspace"))
+	if err != nil {
+		writeSetupError(w, err)
+		return
+	}
+	if query.Get("path") == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	path, err := resolveInWorkspace(root, root, query.Get("path"))
+	if err != nil {
+		writeSetupError(w, err)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no such file", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	// the file may still be growing (e.g., a log file of a running job), so
+	// hash and serve exactly the part of it that exists now
+	content := io.NewSectionReader(file, 0, fi.Size())
+	hash := sha256.New()
+	if _, err = io.Copy(hash, content); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Content-SHA256", hex.EncodeToString(hash.Sum(nil)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name()}))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateOutput(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "out")
+	assert.NoError(t, os.WriteFile(fileName, []byte("old\n"), 0666))
+
+	// the job writes straight to the file, and its output is copied to the
+	// ring buffer
+	rb := datamodel.NewRingBuffer(64)
+	w, done, err := createOutput(rb, fileName, true)
+	require.NoError(t, err)
+	assert.IsType(t, &os.File{}, w)
+	w.Write([]byte("new\n"))
+	done()
+	b, _ := os.ReadFile(fileName)
+	assert.Equal(t, "old\nnew\n", string(b))
+	data, _, _, _ := rb.Snapshot(0)
+	assert.Equal(t, "new\n", string(data))
+
+	// without a file, it writes to the ring buffer itself
+	w, done, err = createOutput(rb, "", false)
+	require.NoError(t, err)
+	assert.Same(t, rb, w)
+	done()
+}
+
+// TestKeptJobHelper isn't a real test: TestKeptJobOutlivesServer runs it in a
+// process of its own, which stands in for a server that starts a job and then
+// exits, leaving the job running.
+func TestKeptJobHelper(t *testing.T) {
+	dir := os.Getenv("KEPT_JOB_DIR")
+	if dir == "" {
+		t.Skip("only run by TestKeptJobOutlivesServer")
+	}
+	workspaceRoot = dir
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "w"), 0755))
+	p := &datamodel.ProcessJobStruct{
+		Stdout: datamodel.NewRingBuffer(ringBufferSize),
+		Stderr: datamodel.NewRingBuffer(ringBufferSize),
+		Command: datamodel.JsonCommandStruct{
+			Cmd:        "sh",
+			Args:       []string{"-c", "while :; do echo tick; echo tock >&2; sleep 0.05; done"},
+			Workspace:  "w",
+			StdoutFile: filepath.Join(dir, "w", "out"),
+			StderrFile: filepath.Join(dir, "w", "err"),
+		},
+		Started: make(chan struct{}),
+		Done:    make(chan struct{}),
+	}
+	_, err := startJob(p)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pid"), []byte(strconv.Itoa(p.Pid)), 0666))
+}
+
+func TestKeptJobOutlivesServer(t *testing.T) {
+	dir := t.TempDir()
+	helper := exec.Command(os.Args[0], "-test.run=^TestKeptJobHelper$")
+	helper.Env = append(os.Environ(), "KEPT_JOB_DIR="+dir)
+	out, err := helper.CombinedOutput()
+	require.NoError(t, err, string(out))
+	b, err := os.ReadFile(filepath.Join(dir, "pid"))
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(string(b))
+	require.NoError(t, err)
+	defer syscall.Kill(-pid, syscall.SIGKILL)
+
+	// the server has gone, but the job is still running, and writing to its
+	// output files
+	ticks, err := processStartTicks(pid)
+	require.NoError(t, err)
+	size := func(name string) int64 {
+		fi, err := os.Stat(filepath.Join(dir, "w", name))
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	stdoutSize, stderrSize := size("out"), size("err")
+	time.Sleep(500 * time.Millisecond)
+	assert.True(t, processAlive(pid, ticks))
+	assert.Greater(t, size("out"), stdoutSize)
+	assert.Greater(t, size("err"), stderrSize)
+	b, _ = os.ReadFile(filepath.Join(dir, "w", "out"))
+	assert.True(t, strings.HasPrefix(string(b), "tick\ntick\n"))
+}
+
+func TestHandleKillJobBlankSelector(t *testing.T) {
+	// (these are refused before any job is looked at)
+	for _, body := range []string{`{"selector":""}`, `{"selector":" "}`, `{"selector":" , "}`} {
+		w := httptest.NewRecorder()
+		handleKillJob(w, httptest.NewRequest(http.MethodPost, "/kill", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+func TestSetupCommand(t *testing.T) {
+	oldRoot := workspaceRoot
+	defer func() { workspaceRoot = oldRoot }()
+	workspaceRoot = t.TempDir()
+	root := filepath.Join(workspaceRoot, "exp1")
+	require.NoError(t, os.Mkdir(root, 0755))
+	t.Setenv("SETUP_COMMAND_TEST", "old")
+	setup := func(c datamodel.JsonCommandStruct) (*exec.Cmd, error) {
+		c.Cmd, c.Workspace = "true", "exp1"
+		cmd := exec.Command(c.Cmd)
+		dir, err := setupCommand(cmd, c)
+		if err == nil {
+			assert.Equal(t, root, dir)
+		}
+		return cmd, err
+	}
+
+	// the working directory defaults to the workspace, and isn't created
+	// until the command has passed the policy check
+	cmd, err := setup(datamodel.JsonCommandStruct{})
+	require.NoError(t, err)
+	assert.Equal(t, root, cmd.Dir)
+	assert.Nil(t, cmd.Env)
+	cmd, err = setup(datamodel.JsonCommandStruct{Cwd: "iter1/sub"})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "iter1", "sub"), cmd.Dir)
+	assert.NoDirExists(t, cmd.Dir)
+	_, err = setup(datamodel.JsonCommandStruct{Cwd: "../exp2"})
+	assert.Error(t, err)
+
+	// Env is merged into the server's environment (overriding it, since later
+	// entries win), or replaces it
+	cmd, err = setup(datamodel.JsonCommandStruct{Env: map[string]string{"SETUP_COMMAND_TEST": "new", "A": "1"}})
+	require.NoError(t, err)
+	assert.Equal(t, append(os.Environ(), "A=1", "SETUP_COMMAND_TEST=new"), cmd.Env)
+	cmd, err = setup(datamodel.JsonCommandStruct{Env: map[string]string{"B": "2", "A": "1"}, ClearEnv: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A=1", "B=2"}, cmd.Env)
+	cmd, err = setup(datamodel.JsonCommandStruct{ClearEnv: true})
+	require.NoError(t, err)
+	assert.NotNil(t, cmd.Env)
+	assert.Empty(t, cmd.Env)
+
+	for _, name := range []string{"", "A=B", "A\x00"} {
+		_, err := setup(datamodel.JsonCommandStruct{Env: map[string]string{name: "1"}})
+		assert.Error(t, err, "%q", name)
+	}
+}
+
+func TestPolicyCheckedBeforeWorkingDir(t *testing.T) {
+	oldRoot, oldPolicy := workspaceRoot, commandPolicy
+	defer func() { workspaceRoot, commandPolicy = oldRoot, oldPolicy }()
+	workspaceRoot = t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(workspaceRoot, "exp1"), 0755))
+	// (a policy without rules allows nothing)
+	commandPolicy = &policy{}
+
+	for endpoint, handler := range map[string]http.HandlerFunc{
+		"/runToCompletion": handleRunToCompletion,
+		"/runInBackground": handleRunInBackground,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, endpoint, strings.NewReader(`{"cmd":"true","workspace":"exp1","cwd":"new"}`)))
+		assert.Equal(t, http.StatusForbidden, w.Code, endpoint)
+		assert.NoDirExists(t, filepath.Join(workspaceRoot, "exp1", "new"), endpoint)
+	}
+}
+
+func TestHandleDownloadFile(t *testing.T) {
+	oldRoot := workspaceRoot
+	defer func() { workspaceRoot = oldRoot }()
+	workspaceRoot = t.TempDir()
+	root := filepath.Join(workspaceRoot, "exp1")
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("top secret"), 0666))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "iter1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "iter1", "tgen.log"), []byte("0123456789"), 0666))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	download := func(query string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/download?"+query, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handleDownloadFile(w, r)
+		return w
+	}
+	// the hash is always that of the whole file
+	sum := sha256.Sum256([]byte("0123456789"))
+	hash := hex.EncodeToString(sum[:])
+
+	w := download("workspace=exp1&path=iter1/tgen.log", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.Equal(t, hash, w.Header().Get("X-Content-SHA256"))
+	assert.Equal(t, `attachment; filename=tgen.log`, w.Header().Get("Content-Disposition"))
+
+	w = download("workspace=exp1&path=iter1/tgen.log", http.Header{"Range": {"bytes=2-5"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "2345", w.Body.String())
+	assert.Equal(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+	assert.Equal(t, hash, w.Header().Get("X-Content-SHA256"))
+	w = download("workspace=exp1&path=iter1/tgen.log", http.Header{"Range": {"bytes=8-"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "89", w.Body.String())
+	w = download("workspace=exp1&path=iter1/tgen.log", http.Header{"Range": {"bytes=20-"}})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+
+	// paths are confined to the workspace
+	for _, path := range []string{"../exp2/tgen.log", "iter1/../../x", "/etc/passwd", "escape/secret"} {
+		w := download("workspace=exp1&path="+path, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		assert.NotContains(t, w.Body.String(), "top secret", path)
+	}
+	// (the default workspace is a workspace of its own)
+	assert.Equal(t, http.StatusNotFound, download("path=exp1/iter1/tgen.log", nil).Code)
+
+	assert.Equal(t, http.StatusNotFound, download("workspace=exp1&path=iter1/nope.log", nil).Code)
+	assert.Equal(t, http.StatusNotFound, download("workspace=exp2&path=iter1/tgen.log", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, download("workspace=exp1&path=iter1", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, download("workspace=exp1", nil).Code)
+}
+
+// runInBackground starts a job via handleRunInBackground, and returns the job
+// as described in the response.
+func runInBackground(t *testing.T, body string) datamodel.JsonJobStruct {
+	w := httptest.NewRecorder()
+	handleRunInBackground(w, httptest.NewRequest(http.MethodPost, "/runInBackground", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var job datamodel.JsonJobStruct
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	return job
+}
+
+func TestRunInBackgroundResponse(t *testing.T) {
+	root := runJobManager(t)
+	before := time.Now()
+	job := runInBackground(t, `{"cmd":"sleep","args":["0.2"],"workspace":"exp1","cwd":"iter1","stdout":"out.log","stderr":"../err.log","labels":{"app":"test"}}`)
+	assert.NotZero(t, job.JobNo)
+	assert.NotZero(t, job.Pid)
+	assert.Equal(t, "sleep 0.2", job.CmdLine)
+	assert.Equal(t, "exp1", job.Workspace)
+	assert.Equal(t, datamodel.JobRunning, job.State)
+	assert.WithinDuration(t, before, job.StartTime, time.Second)
+	// the working directory and output files are reported as absolute paths
+	assert.Equal(t, filepath.Join(root, "iter1"), job.Cwd)
+	assert.Equal(t, filepath.Join(root, "iter1", "out.log"), job.StdoutFile)
+	assert.Equal(t, filepath.Join(root, "err.log"), job.StderrFile)
+	assert.Equal(t, map[string]string{"app": "test"}, job.Labels)
+	assert.Nil(t, job.Exit)
+
+	// and the job number identifies the job from then on
+	exited := waitForJob(t, job.JobNo, 5*time.Second)
+	assert.Equal(t, job.Pid, exited.Pid)
+	assert.Equal(t, datamodel.JobExited, exited.State)
+
+	// jobs get numbers of their own
+	other := runInBackground(t, `{"cmd":"true","workspace":"exp1"}`)
+	assert.NotEqual(t, job.JobNo, other.JobNo)
+	assert.Empty(t, other.StdoutFile)
+	waitForJob(t, other.JobNo, 5*time.Second)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// archiveMaxBytes is the largest total (uncompressed) size of the files that
+// "/archive" will send
+var archiveMaxBytes int64 = 1 << 30
+
+// maxArchiveGlobs is the most glob patterns that one archive request may have
+const maxArchiveGlobs = 64
+
+// archiveFile is a file to be included in an archive.
+type archiveFile struct {
+	path string // absolute path
+	name string // name in the archive, relative to the workspace
+	info fs.FileInfo
+}
+
+// findArchiveFiles returns the regular files in the workspace rooted at root
+// that match any of the glob patterns. Directories that match are included
+// recursively. Files that lead outside the workspace (via symbolic links) are
+// skipped, and their names (relative to the workspace) returned separately.
+func findArchiveFiles(root string, globs []string) (files []archiveFile, skipped []string, err error) {
+	found := make(map[string]archiveFile)
+	escaped := make(map[string]bool)
+
+	addFile := func(path string) error {
+		// make sure that the file (after following symbolic links) is inside
+		// the workspace
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if _, err := resolveInWorkspace(root, root, name); err != nil {
+			escaped[name] = true
+			return nil
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			found[name] = archiveFile{path: path, name: name, info: fi}
+		}
+		return nil
+	}
+
+	for _, glob := range globs {
+		if filepath.IsAbs(glob) || !isWithin(root, filepath.Join(root, glob)) {
+			return nil, nil, fmt.Errorf("%q: pattern escapes the workspace", glob)
+		}
+		matches, err := filepath.Glob(filepath.Join(root, glob))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q: %v", glob, err)
+		}
+		for _, match := range matches {
+			err := filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				return addFile(path)
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	files = make([]archiveFile, 0, len(found))
+	for _, file := range found {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	for name := range escaped {
+		skipped = append(skipped, name)
+	}
+	sort.Strings(skipped)
+	return files, skipped, nil
+}
+
+// writeArchive writes the files to w as a gzip-compressed tarball.
+func writeArchive(w io.Writer, files []archiveFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		header, err := tar.FileInfoHeader(file.info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(file.name)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+		// the file may have grown since we looked at it (e.g., a log file of
+		// a running job); only send the part that the header promised
+		_, err = io.Copy(tw, io.NewSectionReader(f, 0, file.info.Size()))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// handleArchive handles the "/archive" endpoint and streams a gzip-compressed
+// tarball of the files in the (optional) "workspace" that match any of the
+// "glob" query parameters. The optional "maxBytes" parameter lowers the limit
+// on the total size of the files. Files that lead outside the workspace are
+// left out, and counted in the X-Archive-Skipped header. The SHA-256 hash of
+// the tarball is sent in the X-Content-SHA256 trailer.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	workspace := query.Get("workspace")
+	root, err := workspaceDir(workspace)
+	if err != nil {
+		writeSetupError(w, err)
+		return
+	}
+
+	globs := query["glob"]
+	if len(globs) == 0 || len(globs) > maxArchiveGlobs {
+		http.Error(w, fmt.Sprintf("between 1 and %d glob parameters are required", maxArchiveGlobs), http.StatusBadRequest)
+		return
+	}
+	maxBytes := archiveMaxBytes
+	if s := query.Get("maxBytes"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid maxBytes", http.StatusBadRequest)
+			return
+		}
+		if n < maxBytes {
+			maxBytes = n
+		}
+	}
+
+	files, skipped, err := findArchiveFiles(root, globs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(skipped) > 0 {
+		log.Printf("warning: leaving files that lead outside workspace %v out of its archive: %v", root, skipped)
+	}
+	var total int64
+	for _, file := range files {
+		total += file.info.Size()
+	}
+	if total > maxBytes {
+		http.Error(w, fmt.Sprintf("archive would be %d bytes, which is more than the limit of %d", total, maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	name := workspace
+	if name == "" {
+		name = "archive"
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".tar.gz"}))
+	w.Header().Set("X-Archive-Files", strconv.Itoa(len(files)))
+	w.Header().Set("X-Archive-Skipped", strconv.Itoa(len(skipped)))
+	w.Header().Set("Trailer", "X-Content-SHA256")
+	w.WriteHeader(http.StatusOK)
+
+	hash := sha256.New()
+	if err = writeArchive(io.MultiWriter(w, hash), files); err != nil {
+		// it's too late to report an error to the client, who will notice
+		// the truncated archive (and missing trailer)
+		log.Printf("warning: cannot write archive of %v in %v: %v", globs, root, err)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set("X-Content-SHA256", hex.EncodeToString(hash.Sum(nil)))
+}
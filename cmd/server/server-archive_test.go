@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newArchiveWorkspace makes a workspace "exp" (in a new workspace root) with a
+// few files, and symbolic links that lead outside of it.
+func newArchiveWorkspace(t *testing.T) string {
+	oldRoot := workspaceRoot
+	t.Cleanup(func() { workspaceRoot = oldRoot })
+	workspaceRoot = t.TempDir()
+	root := filepath.Join(workspaceRoot, "exp")
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0666))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "iter1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "tgen.log"), []byte("tgen"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "iter1", "ptadapter.log"), []byte("ptadapter"), 0666))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "iter1", "secret")))
+	// (a link that stays inside the workspace is fine)
+	require.NoError(t, os.Symlink("../tgen.log", filepath.Join(root, "iter1", "tgen.log")))
+	return root
+}
+
+func TestFindArchiveFiles(t *testing.T) {
+	root := newArchiveWorkspace(t)
+
+	files, skipped, err := findArchiveFiles(root, []string{"*"})
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.name)
+	}
+	assert.Equal(t, []string{"iter1/ptadapter.log", "iter1/tgen.log", "tgen.log"}, names)
+	assert.Equal(t, []string{"iter1/secret", "link"}, skipped)
+
+	files, skipped, err = findArchiveFiles(root, []string{"*.log", "iter1/*.log"})
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+	assert.Empty(t, skipped)
+
+	for _, glob := range []string{"../*", "iter1/../../*", "/etc/*"} {
+		_, _, err := findArchiveFiles(root, []string{glob})
+		assert.Error(t, err, glob)
+	}
+}
+
+func TestHandleArchive(t *testing.T) {
+	newArchiveWorkspace(t)
+	archive := func(query string) *http.Response {
+		w := httptest.NewRecorder()
+		handleArchive(w, httptest.NewRequest(http.MethodGet, "/archive?"+query, nil))
+		return w.Result()
+	}
+
+	res := archive("workspace=exp&glob=*")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "3", res.Header.Get("X-Archive-Files"))
+	assert.Equal(t, "2", res.Header.Get("X-Archive-Skipped"))
+	body, _ := io.ReadAll(res.Body)
+	sum := sha256.Sum256(body)
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.Trailer.Get("X-Content-SHA256"))
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	contents := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, _ := io.ReadAll(tr)
+		contents[header.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		"tgen.log":            "tgen",
+		"iter1/ptadapter.log": "ptadapter",
+		"iter1/tgen.log":      "tgen",
+	}, contents)
+
+	// the files come to 17 bytes
+	assert.Equal(t, http.StatusOK, archive("workspace=exp&glob=*&maxBytes=17").StatusCode)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, archive("workspace=exp&glob=*&maxBytes=16").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, archive("workspace=exp&glob=*&maxBytes=0").StatusCode)
+
+	assert.Equal(t, http.StatusBadRequest, archive("workspace=exp&glob=../*").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, archive("workspace=exp").StatusCode)
+	assert.Equal(t, http.StatusNotFound, archive("workspace=nope&glob=*").StatusCode)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"datamodel"
+)
+
+// auditLog is an append-only JSONL file of datamodel.JsonAuditStruct
+// records. Once it grows past maxBytes, it's renamed to path.1 (and any older
+// files to path.2, etc., keeping at most keep of them) and a new one is
+// started. A nil *auditLog records nothing.
+type auditLog struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// audit is the audit log given on the command line, if any
+var audit *auditLog
+
+// openAuditLog opens (or creates) the audit log at path.
+func openAuditLog(path string, maxBytes int64, keep int) (*auditLog, error) {
+	a := &auditLog{path: path, maxBytes: maxBytes, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, fi.Size()
+	return nil
+}
+
+// rotatedPath returns the name of the i'th oldest rotated file (or of the
+// current file, if i is 0).
+func (a *auditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return a.path
+	}
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// rotate renames the current file out of the way and starts a new one.
+// a.lock must be held.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	os.Remove(a.rotatedPath(a.keep))
+	for i := a.keep - 1; i >= 0; i-- {
+		if err := os.Rename(a.rotatedPath(i), a.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// record appends a record to the log, filling in its time.
+func (a *auditLog) record(rec datamodel.JsonAuditStruct) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("warning: cannot encode audit record: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		// a previous rotation failed; try again
+		if err := a.open(); err != nil {
+			log.Printf("warning: cannot open audit log: %v", err)
+			return
+		}
+	}
+	if a.size > 0 && a.size+int64(len(b)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			log.Printf("warning: cannot rotate audit log: %v", err)
+			a.file = nil
+			return
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("warning: cannot write audit log: %v", err)
+	}
+}
+
+// close flushes the log to disk and closes it.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		if err := a.file.Sync(); err != nil {
+			log.Printf("warning: cannot flush audit log: %v", err)
+		}
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// since returns the records (from the current file and the rotated ones) with
+// times at or after t, oldest first.
+func (a *auditLog) since(t time.Time) ([]datamodel.JsonAuditStruct, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	records := make([]datamodel.JsonAuditStruct, 0)
+	for i := a.keep; i >= 0; i-- {
+		f, err := os.Open(a.rotatedPath(i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var rec datamodel.JsonAuditStruct
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			if !rec.Time.Before(t) {
+				records = append(records, rec)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// requestInfo describes a request, for the audit log. The authentication
+// middleware fills in the identity.
+type requestInfo struct {
+	id       string
+	identity *identity
+}
+
+type requestInfoKeyType struct{}
+
+// requestInfoKey is the context key under which a request's requestInfo is
+// stored
+var requestInfoKey = requestInfoKeyType{}
+
+// getRequestInfo returns the request's requestInfo, or an empty one if it
+// has none.
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// identityName returns the name of the identity that made the request, or ""
+// if it's unknown.
+func (info *requestInfo) identityName() string {
+	if info.identity == nil {
+		return ""
+	}
+	return info.identity.Name
+}
+
+// newRequestID returns a random id for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// auditMiddleware gives each request an id (which is sent back in the
+// X-Request-ID header) and records it in the audit log once it has been
+// handled. It must come before the authentication middleware.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{id: newRequestID()}
+		w.Header().Set("X-Request-ID", info.id)
+		recorder := &statusRecorder{ResponseWriter: w}
+		completed := false
+
+		// record the request even if the handler panics (e.g. to abort a
+		// response)
+		defer func() {
+			if recorder.status == 0 && completed {
+				recorder.status = http.StatusOK
+			}
+			rec := datamodel.JsonAuditStruct{
+				Event:      datamodel.AuditRequest,
+				RequestID:  info.id,
+				RemoteAddr: r.RemoteAddr,
+				Method:     r.Method,
+				Endpoint:   r.URL.RequestURI(),
+				Status:     recorder.status,
+			}
+			if info.identity != nil {
+				rec.Identity = info.identity.Name
+			}
+			audit.record(rec)
+		}()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+		completed = true
+	})
+}
+
+// auditStart records that the request with the given id (made by identity)
+// started a process. jobNo is nil if the process isn't a background job.
+func auditStart(requestID, identity string, cmd *exec.Cmd, c datamodel.JsonCommandStruct, jobNo *datamodel.JobNoType) {
+	audit.record(datamodel.JsonAuditStruct{
+		Event:     datamodel.AuditStart,
+		RequestID: requestID,
+		Identity:  identity,
+		JobNo:     jobNo,
+		Pid:       cmd.Process.Pid,
+		Cmd:       c.Cmd,
+		Args:      c.Args,
+		User:      c.User,
+		Workspace: c.Workspace,
+		Cwd:       cmd.Dir,
+	})
+}
+
+// auditExit records that a process started by the request with the given id
+// exited.
+func auditExit(requestID string, jobNo *datamodel.JobNoType, pid int, exit *datamodel.JsonExitStruct) {
+	audit.record(datamodel.JsonAuditStruct{
+		Event:     datamodel.AuditExit,
+		RequestID: requestID,
+		JobNo:     jobNo,
+		Pid:       pid,
+		Exit:      exit,
+	})
+}
+
+// auditUpload records that request r uploaded a file.
+func auditUpload(r *http.Request, workspace, path string, size int64, sha256 string) {
+	info := getRequestInfo(r)
+	rec := datamodel.JsonAuditStruct{
+		Event:     datamodel.AuditUpload,
+		RequestID: info.id,
+		Workspace: workspace,
+		File:      path,
+		Size:      size,
+		SHA256:    sha256,
+	}
+	if info.identity != nil {
+		rec.Identity = info.identity.Name
+	}
+	audit.record(rec)
+}
+
+// handleAudit handles the "/audit" endpoint and returns the audit log records
+// since the (RFC 3339) time given by the optional "since" query parameter.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "audit log not enabled", http.StatusNotFound)
+		return
+	}
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := audit.since(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(records, w)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(path, 300, 2)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		jobNo := datamodel.JobNoType(i)
+		a.record(datamodel.JsonAuditStruct{Event: datamodel.AuditStart, JobNo: &jobNo, Cmd: "/bin/true"})
+	}
+
+	// only the newest files are kept, and none of them is much too big
+	for _, suffix := range []string{"", ".1", ".2"} {
+		fi, err := os.Stat(path + suffix)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, fi.Size(), int64(300))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	records, err := a.since(start)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, records)
+	assert.Less(t, len(records), 20)
+	for i, rec := range records {
+		// oldest first, and the newest is the last one written
+		assert.Equal(t, datamodel.JobNoType(20-len(records)+i), *rec.JobNo)
+	}
+
+	records, err = a.since(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	// reopening appends to the current file
+	b, err := openAuditLog(path, 300, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, a.size, b.size)
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	audit, err = openAuditLog(path, 1<<20, 1)
+	assert.NoError(t, err)
+	defer func() { audit = nil }()
+
+	fileName := filepath.Join(t.TempDir(), "tokens.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(testTokens), 0600))
+	amw := authenticationMiddleware{}
+	amw.Init(fileName)
+	r := newTestRouter(&amw)
+
+	w := testRequest(r, http.MethodGet, "/jobs?state=all", "s3cret-observer")
+	assert.Equal(t, http.StatusOK, w.Code)
+	requestID := w.Header().Get("X-Request-ID")
+	assert.NotEmpty(t, requestID)
+	testRequest(r, http.MethodGet, "/exit", "s3cret-observer")
+	testRequest(r, http.MethodGet, "/exit", "wrong")
+
+	records, err := audit.since(time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, datamodel.AuditRequest, records[0].Event)
+		assert.Equal(t, requestID, records[0].RequestID)
+		assert.Equal(t, "student", records[0].Identity)
+		assert.Equal(t, "/jobs?state=all", records[0].Endpoint)
+		assert.Equal(t, http.StatusOK, records[0].Status)
+
+		// refused requests are recorded too
+		assert.Equal(t, "student", records[1].Identity)
+		assert.Equal(t, http.StatusForbidden, records[1].Status)
+		assert.Equal(t, "", records[2].Identity)
+		assert.Equal(t, http.StatusForbidden, records[2].Status)
+	}
+}
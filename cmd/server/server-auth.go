@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+)
+
+// roleType is what an authenticated client is allowed to do. Each role can
+// do everything that the roles below it can.
+type roleType int
+
+const (
+	roleNone     roleType = iota
+	roleMetrics           // may only scrape metrics
+	roleObserver          // may also list jobs, stream output and download files
+	roleOperator          // may also run and kill jobs, and upload files
+	roleAdmin             // may also make the server exit
+)
+
+var roleNames = map[string]roleType{
+	"metrics":  roleMetrics,
+	"observer": roleObserver,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+func (role roleType) String() string {
+	for name, r := range roleNames {
+		if r == role {
+			return name
+		}
+	}
+	return "none"
+}
+
+func (role roleType) MarshalText() ([]byte, error) {
+	return []byte(role.String()), nil
+}
+
+func (role *roleType) UnmarshalText(b []byte) error {
+	r, ok := roleNames[string(b)]
+	if !ok {
+		return fmt.Errorf("unknown role %q", b)
+	}
+	*role = r
+	return nil
+}
+
+// routeRoles gives the role needed for each route (by its path template).
+// Routes that aren't listed need roleAdmin.
+var routeRoles = map[string]roleType{
+	"/metrics":                 roleMetrics,
+	"/version":                 roleObserver,
+	"/sysinfo":                 roleObserver,
+	"/jobs":                    roleObserver,
+	"/jobs/{id:[0-9]+}/stream": roleObserver,
+	"/download":                roleObserver,
+	"/archive":                 roleObserver,
+	"/workspaces":              roleObserver,
+	"/workspaces/{name}":       roleObserver, // but see requiredRole
+	"/runToCompletion":         roleOperator,
+	"/runInBackground":         roleOperator,
+	"/kill":                    roleOperator,
+	"/upload":                  roleOperator,
+	"/exit":                    roleAdmin,
+	"/audit":                   roleAdmin,
+}
+
+// requiredRole returns the role needed to make request r.
+func requiredRole(r *http.Request) roleType {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return roleAdmin
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return roleAdmin
+	}
+	role, ok := routeRoles[template]
+	if !ok {
+		return roleAdmin
+	}
+	// creating and deleting workspaces changes things
+	if template == "/workspaces/{name}" && r.Method != http.MethodGet {
+		role = roleOperator
+	}
+	return role
+}
+
+// identity is an authenticated client.
+type identity struct {
+	Name string   `json:"name"`
+	Role roleType `json:"role"`
+}
+
+type identityKeyType struct{}
+
+// identityKey is the context key under which a request's identity is stored
+var identityKey = identityKeyType{}
+
+// requestIdentity returns the identity that made the request, if any.
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityKey).(*identity)
+	return id
+}
+
+// tokenStruct is a named token, as read from the tokens file. Instead of (or
+// as well as) a token, an entry may give the common name of the subject of a
+// client certificate.
+type tokenStruct struct {
+	identity
+	Token   string `json:"token"`
+	Subject string `json:"subject"`
+
+	hash [sha256.Size]byte
+}
+
+// maxSignedBodySize is the largest body that a signed request may have, since
+// the body must be read into memory to check its signature
+const maxSignedBodySize = 64 << 20
+
+// maxNonceLength is the longest nonce that a signed request may have
+const maxNonceLength = 64
+
+// authenticationMiddleware is a middleware for validating requests using a
+// session token, or an HMAC signature keyed by one.
+type authenticationMiddleware struct {
+	tokens     []*tokenStruct
+	tokensFile string
+
+	// requireSignatures rejects requests that aren't signed (or made with a
+	// client certificate)
+	requireSignatures bool
+	// clientCerts is set if clients must present a verified certificate. If
+	// there's no tokens file, any such certificate then identifies an admin.
+	clientCerts bool
+	// signatureSkew is how far a signed request's timestamp may be from now
+	signatureSkew time.Duration
+
+	// nonces of recent signed requests, and their timestamps
+	nonces     map[string]time.Time
+	noncesLock sync.Mutex
+}
+
+// Init initializes the authentication middleware by reading the tokens file
+// or, if there isn't one, by grabbing the token from the environment (which
+// may be left unset if clients must present certificates).
+func (amw *authenticationMiddleware) Init(tokensFile string) {
+	amw.tokensFile = tokensFile
+	if tokensFile != "" {
+		b, err := os.ReadFile(tokensFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var contents struct {
+			Tokens []*tokenStruct `json:"tokens"`
+		}
+		if err = json.Unmarshal(b, &contents); err != nil {
+			log.Fatalf("%s: %v", tokensFile, err)
+		}
+		for _, t := range contents.Tokens {
+			if t.Name == "" || (t.Token == "" && t.Subject == "") || t.Role == roleNone {
+				log.Fatalf("%s: every token needs a name, a token or subject, and a role", tokensFile)
+			}
+		}
+		amw.tokens = contents.Tokens
+		log.Printf("loaded %d tokens from %s", len(amw.tokens), tokensFile)
+	} else {
+		authToken := os.Getenv("SERVER_AUTH_TOKEN")
+		if authToken != "" {
+			amw.tokens = []*tokenStruct{{
+				identity: identity{Name: "default", Role: roleAdmin},
+				Token:    authToken,
+			}}
+		} else if !amw.clientCerts {
+			log.Fatal("SERVER_AUTH_TOKEN not set")
+		}
+	}
+	for _, t := range amw.tokens {
+		t.hash = sha256.Sum256([]byte(t.Token))
+	}
+}
+
+// lookupToken returns the identity that the token belongs to, or nil. The
+// comparisons take the same time however much of the token is correct.
+func (amw *authenticationMiddleware) lookupToken(token string) *identity {
+	if token == "" {
+		return nil
+	}
+	// compare hashes, so that the lengths of the tokens aren't revealed either
+	hash := sha256.Sum256([]byte(token))
+	var found *identity
+	for _, t := range amw.tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			found = &t.identity
+		}
+	}
+	return found
+}
+
+// lookupCertificate returns the identity that the request's (verified)
+// client certificate belongs to, or nil.
+func (amw *authenticationMiddleware) lookupCertificate(r *http.Request) *identity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if subject == "" {
+		return nil
+	}
+	for _, t := range amw.tokens {
+		if t.Subject == subject {
+			return &t.identity
+		}
+	}
+	if amw.clientCerts && amw.tokensFile == "" {
+		return &identity{Name: subject, Role: roleAdmin}
+	}
+	return nil
+}
+
+// checkSignature verifies a signed request (see datamodel.SignRequest) and
+// returns the identity whose token signed it. The request's body is read, and
+// replaced so that it can be read again by the handler.
+func (amw *authenticationMiddleware) checkSignature(r *http.Request) (*identity, error) {
+	timestamp := r.Header.Get(datamodel.TimestampHeader)
+	nonce := r.Header.Get(datamodel.NonceHeader)
+	signature, err := hex.DecodeString(r.Header.Get(datamodel.SignatureHeader))
+	if err != nil || timestamp == "" || nonce == "" || len(nonce) > maxNonceLength {
+		return nil, errors.New("malformed signature")
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed timestamp")
+	}
+	if skew := time.Since(time.Unix(secs, 0)); skew > amw.signatureSkew || skew < -amw.signatureSkew {
+		return nil, fmt.Errorf("stale timestamp (%v off)", skew.Round(time.Second))
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBodySize))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var found *identity
+	for _, t := range amw.tokens {
+		if t.Token == "" {
+			// certificate-only entries can't sign
+			continue
+		}
+		expected, _ := hex.DecodeString(datamodel.SignRequest([]byte(t.Token), r.Method, r.RequestURI, timestamp, nonce, body))
+		if hmac.Equal(signature, expected) {
+			found = &t.identity
+		}
+	}
+	if found == nil {
+		return nil, errors.New("bad signature")
+	}
+
+	// only check (and remember) the nonce once we know that the request is
+	// genuine, so that forged requests can't fill up the cache
+	if !amw.useNonce(nonce, time.Unix(secs, 0)) {
+		return nil, errors.New("replayed nonce")
+	}
+	return found, nil
+}
+
+// useNonce records that a nonce has been used by a request with the given
+// timestamp, and returns false if it had been used already. Nonces are
+// forgotten once their timestamps are too old to be accepted anyway.
+func (amw *authenticationMiddleware) useNonce(nonce string, timestamp time.Time) bool {
+	amw.noncesLock.Lock()
+	defer amw.noncesLock.Unlock()
+
+	if amw.nonces == nil {
+		amw.nonces = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for n, t := range amw.nonces {
+		if now.Sub(t) > amw.signatureSkew {
+			delete(amw.nonces, n)
+		}
+	}
+	if _, used := amw.nonces[nonce]; used {
+		return false
+	}
+	amw.nonces[nonce] = timestamp
+	return true
+}
+
+// authenticate returns the identity that made the request, using its
+// signature, its token (unless signatures are required) or, failing those,
+// its client certificate.
+func (amw *authenticationMiddleware) authenticate(r *http.Request) (*identity, error) {
+	if r.Header.Get(datamodel.SignatureHeader) != "" {
+		return amw.checkSignature(r)
+	}
+	token := r.Header.Get("X-Session-Token")
+	if token == "" {
+		// e.g. from Prometheus, which can't send custom headers
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+	}
+	if token != "" {
+		if amw.requireSignatures {
+			return nil, errors.New("unsigned request")
+		}
+		if id := amw.lookupToken(token); id != nil {
+			return id, nil
+		}
+		return nil, errors.New("invalid token")
+	}
+	if id := amw.lookupCertificate(r); id != nil {
+		return id, nil
+	}
+	return nil, errors.New("no credentials")
+}
+
+// Middleware is the middleware function that will be called for each request.
+func (amw *authenticationMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := amw.authenticate(r)
+		if err != nil {
+			// Write an error and stop the handler chain
+			log.Printf("%v from %s for %s", err, r.RemoteAddr, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		getRequestInfo(r).identity = id
+
+		if role := requiredRole(r); id.Role < role {
+			log.Printf("client %q (%v) may not access %s", id.Name, id.Role, r.URL.Path)
+			http.Error(w, fmt.Sprintf("Forbidden: %s requires the %v role", r.URL.Path, role), http.StatusForbidden)
+			return
+		}
+
+		log.Printf("client %q (%v) valid for %s", id.Name, id.Role, r.URL.Path)
+		// Pass down the request to the next middleware (or final handler)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, id)))
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTokens = `{
+  "tokens": [
+    {"name": "prometheus", "token": "s3cret-metrics", "role": "metrics"},
+    {"name": "student", "token": "s3cret-observer", "role": "observer"},
+    {"name": "director", "token": "s3cret-operator", "role": "operator"},
+    {"name": "micah", "token": "s3cret-admin", "role": "admin"},
+    {"name": "bridge", "subject": "bridge.lab", "role": "operator"}
+  ]
+}`
+
+// newTestRouter returns a router with (dummy versions of) the server's
+// routes, protected by amw (and audited, as in main).
+func newTestRouter(amw *authenticationMiddleware) *mux.Router {
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		id := requestIdentity(r)
+		w.Write([]byte(id.Name))
+	}
+	for route := range routeRoles {
+		r.HandleFunc(route, ok)
+	}
+	r.Use(auditMiddleware, amw.Middleware)
+	return r
+}
+
+func testRequest(r http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("X-Session-Token", token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTokenRoles(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "tokens.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(testTokens), 0600))
+	amw := authenticationMiddleware{}
+	amw.Init(fileName)
+	r := newTestRouter(&amw)
+
+	for _, test := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodGet, "/version", "", http.StatusForbidden},
+		{http.MethodGet, "/version", "wrong", http.StatusForbidden},
+		{http.MethodGet, "/version", "s3cret-observe", http.StatusForbidden},
+		{http.MethodGet, "/version", "s3cret-observer", http.StatusOK},
+		{http.MethodGet, "/metrics", "s3cret-metrics", http.StatusOK},
+		{http.MethodGet, "/metrics", "s3cret-observer", http.StatusOK},
+		{http.MethodGet, "/version", "s3cret-metrics", http.StatusForbidden},
+		{http.MethodGet, "/jobs", "s3cret-metrics", http.StatusForbidden},
+		{http.MethodGet, "/jobs", "s3cret-observer", http.StatusOK},
+		{http.MethodGet, "/jobs/3/stream", "s3cret-observer", http.StatusOK},
+		{http.MethodGet, "/download", "s3cret-observer", http.StatusOK},
+		{http.MethodGet, "/workspaces/exp1", "s3cret-observer", http.StatusOK},
+		{http.MethodPut, "/workspaces/exp1", "s3cret-observer", http.StatusForbidden},
+		{http.MethodGet, "/runInBackground", "s3cret-observer", http.StatusForbidden},
+		{http.MethodGet, "/kill", "s3cret-observer", http.StatusForbidden},
+		{http.MethodPut, "/workspaces/exp1", "s3cret-operator", http.StatusOK},
+		{http.MethodGet, "/runInBackground", "s3cret-operator", http.StatusOK},
+		{http.MethodPost, "/upload", "s3cret-operator", http.StatusOK},
+		{http.MethodGet, "/exit", "s3cret-operator", http.StatusForbidden},
+		{http.MethodGet, "/exit", "s3cret-admin", http.StatusOK},
+	} {
+		w := testRequest(r, test.method, test.path, test.token)
+		assert.Equal(t, test.status, w.Code, "%s %s with %q", test.method, test.path, test.token)
+	}
+
+	// the handler sees who made the request
+	assert.Equal(t, "director", testRequest(r, http.MethodGet, "/jobs", "s3cret-operator").Body.String())
+
+	// tokens can also be sent as bearer tokens
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cret-metrics")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "prometheus", w.Body.String())
+	req.Header.Set("Authorization", "Basic s3cret-metrics")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestEnvironmentToken(t *testing.T) {
+	t.Setenv("SERVER_AUTH_TOKEN", "micah1")
+	amw := authenticationMiddleware{}
+	amw.Init("")
+	r := newTestRouter(&amw)
+
+	assert.Equal(t, http.StatusForbidden, testRequest(r, http.MethodGet, "/exit", "micah2").Code)
+	w := testRequest(r, http.MethodGet, "/exit", "micah1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "default", w.Body.String())
+}
+
+// signedRequest returns a request signed with key.
+func signedRequest(method, path, body, key, nonce string, timestamp time.Time) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	req.Header.Set(datamodel.TimestampHeader, ts)
+	req.Header.Set(datamodel.NonceHeader, nonce)
+	req.Header.Set(datamodel.SignatureHeader, datamodel.SignRequest([]byte(key), method, path, ts, nonce, []byte(body)))
+	return req
+}
+
+func TestSignedRequests(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "tokens.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(testTokens), 0600))
+	amw := authenticationMiddleware{signatureSkew: 30 * time.Second}
+	amw.Init(fileName)
+	r := newTestRouter(&amw)
+	r.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	now := time.Now()
+
+	// the signature identifies the token that made it
+	w := serve(signedRequest(http.MethodGet, "/jobs?state=all", "", "s3cret-operator", "n1", now))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "director", w.Body.String())
+	w = serve(signedRequest(http.MethodGet, "/exit", "", "s3cret-operator", "n2", now))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the handler can still read the body
+	w = serve(signedRequest(http.MethodPost, "/echo", `{"cmd":"ls"}`, "s3cret-admin", "n3", now))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"cmd":"ls"}`, w.Body.String())
+
+	// replayed nonce
+	w = serve(signedRequest(http.MethodGet, "/jobs?state=all", "", "s3cret-operator", "n1", now))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// stale and future timestamps
+	w = serve(signedRequest(http.MethodGet, "/jobs", "", "s3cret-operator", "n4", now.Add(-time.Minute)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serve(signedRequest(http.MethodGet, "/jobs", "", "s3cret-operator", "n5", now.Add(time.Minute)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// unknown key
+	w = serve(signedRequest(http.MethodGet, "/jobs", "", "wrong", "n6", now))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// tampered body, path and method
+	req := signedRequest(http.MethodPost, "/echo", `{"cmd":"ls"}`, "s3cret-admin", "n7", now)
+	req.Body = io.NopCloser(strings.NewReader(`{"cmd":"rm"}`))
+	assert.Equal(t, http.StatusForbidden, serve(req).Code)
+	req = signedRequest(http.MethodGet, "/jobs?state=all", "", "s3cret-operator", "n8", now)
+	req.RequestURI = "/jobs?state=running"
+	assert.Equal(t, http.StatusForbidden, serve(req).Code)
+	req = signedRequest(http.MethodGet, "/workspaces/exp1", "", "s3cret-operator", "n9", now)
+	req.Method = http.MethodDelete
+	assert.Equal(t, http.StatusForbidden, serve(req).Code)
+
+	// tokens still work, unless signatures are required
+	assert.Equal(t, http.StatusOK, testRequest(r, http.MethodGet, "/jobs", "s3cret-operator").Code)
+	amw.requireSignatures = true
+	assert.Equal(t, http.StatusForbidden, testRequest(r, http.MethodGet, "/jobs", "s3cret-operator").Code)
+	w = serve(signedRequest(http.MethodGet, "/jobs", "", "s3cret-operator", "n10", now))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// certificateRequest returns a request made with a verified client
+// certificate for the given subject.
+func certificateRequest(method, path, subject string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: subject}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return req
+}
+
+func TestClientCertificates(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "tokens.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(testTokens), 0600))
+	amw := authenticationMiddleware{clientCerts: true}
+	amw.Init(fileName)
+	r := newTestRouter(&amw)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(certificateRequest(http.MethodGet, "/runInBackground", "bridge.lab"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bridge", w.Body.String())
+	assert.Equal(t, http.StatusForbidden, serve(certificateRequest(http.MethodGet, "/exit", "bridge.lab")).Code)
+	assert.Equal(t, http.StatusForbidden, serve(certificateRequest(http.MethodGet, "/version", "unknown.lab")).Code)
+
+	// a token overrides the certificate
+	req := certificateRequest(http.MethodGet, "/exit", "bridge.lab")
+	req.Header.Set("X-Session-Token", "s3cret-admin")
+	w = serve(req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "micah", w.Body.String())
+
+	// certificate-only entries can't be used to sign requests
+	w = serve(signedRequest(http.MethodGet, "/jobs", "", "", "n1", time.Now()))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// without a tokens file, every verified certificate belongs to an admin
+	t.Setenv("SERVER_AUTH_TOKEN", "")
+	amw = authenticationMiddleware{clientCerts: true}
+	amw.Init("")
+	r = newTestRouter(&amw)
+	w = serve(certificateRequest(http.MethodGet, "/exit", "director.lab"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "director.lab", w.Body.String())
+	assert.Equal(t, http.StatusForbidden, testRequest(r, http.MethodGet, "/version", "").Code)
+}
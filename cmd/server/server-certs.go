@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"datamodel"
+)
+
+// certReloader serves the server's TLS certificate, reloading it from its
+// files when they change (e.g. when Let's Encrypt renews it), so that the
+// server doesn't have to be restarted.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	info    datamodel.JsonCertificateStruct
+	modTime time.Time // of the newer of the files, when they were loaded
+}
+
+// certificates is the server's certificate, if it's serving one
+var certificates *certReloader
+
+// newCertReloader loads the certificate and key from the given files.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// filesModTime returns the modification time of the newer of the files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// load (re)loads the certificate and key. The files may only be readable by
+// root, so they're read on the privileged thread (see dropPrivileges).
+func (c *certReloader) load() error {
+	var cert tls.Certificate
+	var modTime time.Time
+	err := runPrivileged(func() error {
+		var err error
+		if modTime, err = c.filesModTime(); err != nil {
+			return err
+		}
+		cert, err = tls.LoadX509KeyPair(c.certPath, c.keyPath)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.info = datamodel.JsonCertificateStruct{
+		Subject:   leaf.Subject.String(),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		LoadedAt:  time.Now(),
+	}
+	if c.info.DNSNames == nil {
+		c.info.DNSNames = []string{}
+	}
+	log.Printf("Loaded certificate for %v, valid until %v", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+	if time.Until(leaf.NotAfter) < 7*24*time.Hour {
+		log.Printf("warning: the certificate expires in less than a week")
+	}
+	return nil
+}
+
+// reload reloads the certificate if its files have changed since it was
+// loaded (or regardless, if force is set). If they can't be loaded (e.g.
+// because only one of them has been replaced so far), the old certificate is
+// kept, and the next reload tries again.
+func (c *certReloader) reload(force bool) {
+	if !force {
+		var modTime time.Time
+		err := runPrivileged(func() error {
+			var err error
+			modTime, err = c.filesModTime()
+			return err
+		})
+		c.lock.RLock()
+		unchanged := err == nil && modTime.Equal(c.modTime)
+		c.lock.RUnlock()
+		if unchanged {
+			return
+		}
+	}
+	if err := c.load(); err != nil {
+		log.Printf("warning: cannot reload certificate (keeping the old one): %v", err)
+	}
+}
+
+// watch reloads the certificate on SIGHUP, and whenever its files change
+// (checking every interval, unless it's 0).
+func (c *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		select {
+		case <-hup:
+			log.Println("Reloading certificate on SIGHUP")
+			c.reload(true)
+		case <-tick:
+			c.reload(false)
+		}
+	}
+}
+
+// getCertificate returns the current certificate, for tls.Config.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// describe describes the current certificate (or returns nil if there's no
+// certReloader).
+func (c *certReloader) describe() *datamodel.JsonCertificateStruct {
+	if c == nil {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	info := c.info
+	return &info
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for name, valid until
+// notAfter, and its key, setting their modification times to modTime.
+func writeTestCertificate(t *testing.T, certPath, keyPath, name string, notAfter, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	for _, path := range []string{certPath, keyPath} {
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	expiry := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCertificate(t, certPath, keyPath, "old.example", expiry, modTime)
+
+	c, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	info := c.describe()
+	assert.Equal(t, "CN=old.example", info.Subject)
+	assert.Equal(t, []string{"old.example"}, info.DNSNames)
+	assert.True(t, expiry.Equal(info.NotAfter))
+	cert, err := c.getCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "old.example", cert.Leaf.Subject.CommonName)
+
+	// nothing has changed
+	c.reload(false)
+	assert.Equal(t, info.LoadedAt, c.describe().LoadedAt)
+
+	// the certificate is renewed
+	writeTestCertificate(t, certPath, keyPath, "new.example", expiry.Add(90*24*time.Hour), modTime.Add(time.Minute))
+	c.reload(false)
+	assert.Equal(t, "CN=new.example", c.describe().Subject)
+	cert, _ = c.getCertificate(nil)
+	assert.Equal(t, "new.example", cert.Leaf.Subject.CommonName)
+
+	// only the certificate has been replaced so far, so keep the old one
+	newCert, newKey := filepath.Join(dir, "cert2.pem"), filepath.Join(dir, "key2.pem")
+	writeTestCertificate(t, newCert, newKey, "newer.example", expiry, modTime.Add(2*time.Minute))
+	require.NoError(t, os.Rename(newCert, certPath))
+	c.reload(true)
+	assert.Equal(t, "CN=new.example", c.describe().Subject)
+
+	_, err = newCertReloader(filepath.Join(dir, "missing.pem"), keyPath)
+	assert.Error(t, err)
+
+	// without a certificate, there's nothing to describe
+	assert.Nil(t, (*certReloader)(nil).describe())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"datamodel"
+)
+
+// cgroupRoot is the cgroup v2 directory under which each job gets a cgroup of
+// its own; if empty, jobs aren't put in cgroups (and can't have resource
+// limits)
+var cgroupRoot string
+
+// cgroupControllers are the controllers that resource limits need
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+// cpuPeriod is the period (in microseconds) over which CPU quotas are
+// enforced
+const cpuPeriod = 100000
+
+// errNoCgroups is returned when a command asks for resource limits but the
+// server wasn't given a cgroup root
+var errNoCgroups = errors.New("resource limits need the server to be run with -cgroup-root")
+
+// initCgroups creates the cgroup root, if necessary, and enables the
+// controllers that jobs' resource limits need in its subtree. The root's
+// parent must already have delegated them (e.g. with systemd's Delegate=yes).
+func initCgroups() error {
+	root, err := filepath.Abs(cgroupRoot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	cgroupRoot = root
+
+	b, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %v", root, err)
+	}
+	available := strings.Fields(string(b))
+	for _, controller := range cgroupControllers {
+		if !contains(available, controller) {
+			log.Printf("warning: the %s controller isn't available in %s; limits that need it will fail", controller, root)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+			log.Printf("warning: cannot enable the %s controller in %s: %v", controller, root, err)
+		}
+	}
+	return nil
+}
+
+// checkResources makes sure that resource limits make sense (and can be
+// enforced).
+func checkResources(res datamodel.JsonResourcesStruct) error {
+	if res == (datamodel.JsonResourcesStruct{}) {
+		return nil
+	}
+	if cgroupRoot == "" {
+		return errNoCgroups
+	}
+	if res.CPUQuota < 0 || res.MemoryMax < 0 || res.PidsMax < 0 {
+		return errors.New("resource limits may not be negative")
+	}
+	if res.IOWeight < 0 || res.IOWeight > 10000 {
+		return errors.New("ioWeight must be between 1 and 10000")
+	}
+	return nil
+}
+
+// writeLimits writes resource limits to the control files of the cgroup dir.
+func writeLimits(dir string, res datamodel.JsonResourcesStruct) error {
+	var limits [][2]string
+	if res.CPUQuota > 0 {
+		quota := int(float64(res.CPUQuota) * cpuPeriod)
+		if quota < 1000 {
+			// the smallest quota that the kernel allows
+			quota = 1000
+		}
+		limits = append(limits, [2]string{"cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)})
+	}
+	if res.MemoryMax > 0 {
+		limits = append(limits, [2]string{"memory.max", strconv.FormatInt(res.MemoryMax, 10)})
+	}
+	if res.PidsMax > 0 {
+		limits = append(limits, [2]string{"pids.max", strconv.Itoa(res.PidsMax)})
+	}
+	if res.IOWeight > 0 {
+		limits = append(limits, [2]string{"io.weight", fmt.Sprintf("default %d", res.IOWeight)})
+	}
+	for _, limit := range limits {
+		if err := os.WriteFile(filepath.Join(dir, limit[0]), []byte(limit[1]), 0644); err != nil {
+			return fmt.Errorf("cannot set %s: %v", limit[0], err)
+		}
+	}
+	return nil
+}
+
+// setupCgroup creates a cgroup with the given name (under cgroupRoot) and
+// the command's resource limits, and arranges for cmd to be started in it.
+// It returns the cgroup's path, and a directory handle to be closed once the
+// command has been started. If the server doesn't use cgroups, the path is
+// empty and the handle nil.
+func setupCgroup(cmd *exec.Cmd, name string, res datamodel.JsonResourcesStruct) (string, *os.File, error) {
+	if cgroupRoot == "" {
+		return "", nil, nil
+	}
+	dir := filepath.Join(cgroupRoot, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	if err := writeLimits(dir, res); err != nil {
+		removeCgroup(dir)
+		return "", nil, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		removeCgroup(dir)
+		return "", nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return dir, f, nil
+}
+
+// removeCgroup removes a job's cgroup, which must have no processes left.
+func removeCgroup(dir string) {
+	if err := os.Remove(dir); err != nil {
+		log.Printf("warning: cannot remove cgroup %s: %v", dir, err)
+	}
+}
+
+// isZombie reports whether a process has exited (but not been waited for).
+func isZombie(pid int) bool {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// cgroupMembers returns the (non-zombie) processes in a cgroup.
+func cgroupMembers(dir string) []int {
+	var pids []int
+	b, _ := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	for _, field := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(field); err == nil && !isZombie(pid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// killCgroup sends sig to every process in a cgroup, escalating to SIGKILL
+// (via cgroup.kill, which catches processes as they fork) after the grace
+// period (see killProcesses).
+func killCgroup(dir string, sig syscall.Signal, grace time.Duration) (pids []int, escalated, reaped bool) {
+	return killProcesses("cgroup "+dir,
+		func() []int { return cgroupMembers(dir) },
+		func(sig syscall.Signal) error {
+			if sig == syscall.SIGKILL {
+				return os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+			}
+			for _, pid := range cgroupMembers(dir) {
+				if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+					return err
+				}
+			}
+			return nil
+		},
+		sig, grace)
+}
+
+// readCgroupInt reads a control file containing a single number, returning
+// 0 if it doesn't exist (e.g. because the controller isn't enabled).
+func readCgroupInt(dir, file string) int64 {
+	b, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return n
+}
+
+// readCgroupKeyed reads a value from a control file of "key value" lines,
+// such as cpu.stat, returning 0 if it isn't there.
+func readCgroupKeyed(dir, file, key string) int64 {
+	f, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupUsage reports the resources used by the processes in a cgroup.
+func cgroupUsage(dir string) *datamodel.JsonUsageStruct {
+	return &datamodel.JsonUsageStruct{
+		CPUSecs:         float64(readCgroupKeyed(dir, "cpu.stat", "usage_usec")) / 1e6,
+		MemoryBytes:     readCgroupInt(dir, "memory.current"),
+		MemoryPeakBytes: readCgroupInt(dir, "memory.peak"),
+		Pids:            int(readCgroupInt(dir, "pids.current")),
+		OOMKills:        int(readCgroupKeyed(dir, "memory.events", "oom_kill")),
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckResources(t *testing.T) {
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+
+	cgroupRoot = ""
+	assert.NoError(t, checkResources(datamodel.JsonResourcesStruct{}))
+	assert.Equal(t, errNoCgroups, checkResources(datamodel.JsonResourcesStruct{PidsMax: 10}))
+
+	cgroupRoot = t.TempDir()
+	assert.NoError(t, checkResources(datamodel.JsonResourcesStruct{CPUQuota: 0.5, MemoryMax: 1 << 30, PidsMax: 10, IOWeight: 50}))
+	assert.Error(t, checkResources(datamodel.JsonResourcesStruct{MemoryMax: -1}))
+	assert.Error(t, checkResources(datamodel.JsonResourcesStruct{IOWeight: 10001}))
+}
+
+func TestWriteLimits(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, writeLimits(dir, datamodel.JsonResourcesStruct{CPUQuota: 1.5, MemoryMax: 256 << 20, PidsMax: 64, IOWeight: 50}))
+	for file, expected := range map[string]string{
+		"cpu.max":    "150000 100000",
+		"memory.max": "268435456",
+		"pids.max":   "64",
+		"io.weight":  "default 50",
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(b), file)
+	}
+
+	// tiny quotas are rounded up to the kernel's minimum; unset limits
+	// aren't written
+	dir = t.TempDir()
+	assert.NoError(t, writeLimits(dir, datamodel.JsonResourcesStruct{CPUQuota: 0.001}))
+	b, _ := os.ReadFile(filepath.Join(dir, "cpu.max"))
+	assert.Equal(t, "1000 100000", string(b))
+	_, err := os.Stat(filepath.Join(dir, "memory.max"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCgroupUsage(t *testing.T) {
+	dir := t.TempDir()
+	for file, contents := range map[string]string{
+		"cpu.stat":       "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n",
+		"memory.current": "1048576\n",
+		"memory.peak":    "4194304\n",
+		"memory.events":  "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+		"pids.current":   "3\n",
+		"cgroup.procs":   "",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644))
+	}
+	assert.Equal(t, &datamodel.JsonUsageStruct{
+		CPUSecs:         2.5,
+		MemoryBytes:     1 << 20,
+		MemoryPeakBytes: 4 << 20,
+		Pids:            3,
+		OOMKills:        1,
+	}, cgroupUsage(dir))
+	assert.Empty(t, cgroupMembers(dir))
+
+	// missing files (e.g. controllers that aren't enabled) read as zero
+	assert.Equal(t, &datamodel.JsonUsageStruct{}, cgroupUsage(t.TempDir()))
+}
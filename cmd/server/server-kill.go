@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"datamodel"
+)
+
+// defaultKillGrace is how long a job's processes are given to exit after the
+// requested signal, before they are sent SIGKILL
+const defaultKillGrace = 5 * time.Second
+
+// killPollInterval is how often we check whether a process group has exited
+const killPollInterval = 50 * time.Millisecond
+
+// signalNames maps the signals that can be requested via "/kill" to their
+// numbers.
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseSignal parses a signal given by name (with or without the "SIG"
+// prefix) or number. The empty string means SIGTERM.
+func parseSignal(s string) (syscall.Signal, error) {
+	if s == "" {
+		return syscall.SIGTERM, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", s)
+	}
+	return sig, nil
+}
+
+// signalName returns the conventional name of a signal, e.g. "SIGTERM".
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// processGroupMembers returns the (non-zombie) processes in a process group,
+// by scanning /proc.
+func processGroupMembers(pgid int) []int {
+	var pids []int
+	statFiles, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, statFile := range statFiles {
+		b, err := os.ReadFile(statFile)
+		if err != nil {
+			// the process has gone away
+			continue
+		}
+		// the fields after the command name (which is in parentheses, and
+		// may itself contain spaces and parentheses) are:
+		// state ppid pgrp ...
+		stat := string(b)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if pg, err := strconv.Atoi(fields[2]); err == nil && pg == pgid {
+			pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(statFile)))
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// waitForExit waits up to timeout for every process returned by members to
+// exit, and reports whether they did.
+func waitForExit(members func() []int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if len(members()) == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(killPollInterval)
+	}
+}
+
+// killProcesses sends sig (using signal) to a set of processes. If any of
+// them (as returned by members) are still around after the grace period,
+// they are sent SIGKILL. It returns the processes that were there to begin
+// with, whether SIGKILL was needed, and whether they are now all gone.
+func killProcesses(what string, members func() []int, signal func(syscall.Signal) error, sig syscall.Signal, grace time.Duration) (pids []int, escalated, reaped bool) {
+	pids = members()
+	// the processes may belong to other users, so only the privileged
+	// thread can signal them
+	signalPrivileged := func(sig syscall.Signal) error {
+		return runPrivileged(func() error { return signal(sig) })
+	}
+	if err := signalPrivileged(sig); err != nil && err != syscall.ESRCH {
+		log.Printf("warning: cannot signal %s: %v", what, err)
+	}
+	if reaped = waitForExit(members, grace); !reaped && sig != syscall.SIGKILL {
+		log.Printf("%s still alive after %v, sending SIGKILL", what, grace)
+		escalated = true
+		signalPrivileged(syscall.SIGKILL)
+		reaped = waitForExit(members, grace)
+	}
+	return pids, escalated, reaped
+}
+
+// killProcessGroup sends sig to every process in a process group, escalating
+// to SIGKILL after the grace period (see killProcesses).
+func killProcessGroup(pgid int, sig syscall.Signal, grace time.Duration) (pids []int, escalated, reaped bool) {
+	return killProcesses(fmt.Sprintf("process group %v", pgid),
+		func() []int { return processGroupMembers(pgid) },
+		func(sig syscall.Signal) error { return syscall.Kill(-pgid, sig) },
+		sig, grace)
+}
+
+// killJob kills every process in the job's cgroup, if it has one, or else in
+// its process group (see killCgroup and killProcessGroup).
+func killJob(p *datamodel.ProcessJobStruct, sig syscall.Signal, grace time.Duration) datamodel.JsonKillResultStruct {
+	// jobs are started as process group leaders, so the group id is the pid
+	res := datamodel.JsonKillResultStruct{
+		JobNo:  p.JobNo,
+		Pgid:   p.Pid,
+		Signal: signalName(sig),
+	}
+	if p.Cgroup != "" {
+		log.Printf("Sending %v to cgroup %v of job %v: %v", sig, p.Cgroup, p.JobNo, p.CmdLine)
+		res.Pids, res.Escalated, res.Reaped = killCgroup(p.Cgroup, sig, grace)
+	} else {
+		log.Printf("Sending %v to process group %v of job %v: %v", sig, p.Pid, p.JobNo, p.CmdLine)
+		res.Pids, res.Escalated, res.Reaped = killProcessGroup(p.Pid, sig, grace)
+	}
+	if res.Pids == nil {
+		res.Pids = []int{}
+	}
+	return res
+}
+
+// jobNumbered returns a function that matches the job with the given number
+// (or every job, if jobNo is -1), for killJobs.
+func jobNumbered(jobNo datamodel.JobNoType) func(*datamodel.ProcessJobStruct) bool {
+	return func(p *datamodel.ProcessJobStruct) bool {
+		return p.JobNo == jobNo || jobNo == -1
+	}
+}
+
+// killJobs kills the running jobs that match (see jobNumbered), and reports
+// what happened. Matching jobs that have no process (pending jobs, and jobs
+// waiting to be restarted) are stopped by the jobManager.
+func killJobs(match func(*datamodel.ProcessJobStruct) bool, sig syscall.Signal, grace time.Duration) []datamodel.JsonKillResultStruct {
+	jobKillChannel <- match
+	jobs := <-jobKillResponseChannel
+
+	// kill the jobs in parallel, so that one slow job doesn't hold up the rest
+	results := make([]datamodel.JsonKillResultStruct, len(jobs.running), len(jobs.running)+len(jobs.stopped))
+	var wg sync.WaitGroup
+	for i, p := range jobs.running {
+		wg.Add(1)
+		go func(i int, p *datamodel.ProcessJobStruct) {
+			defer wg.Done()
+			results[i] = killJob(p, sig, grace)
+		}(i, p)
+	}
+	wg.Wait()
+	for _, job := range jobs.stopped {
+		results = append(results, datamodel.JsonKillResultStruct{
+			JobNo:    job.JobNo,
+			Pids:     []int{},
+			Signal:   signalName(sig),
+			Reaped:   true,
+			Canceled: true,
+		})
+	}
+	return results
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignal(t *testing.T) {
+	for s, expected := range map[string]syscall.Signal{
+		"":        syscall.SIGTERM,
+		"SIGTERM": syscall.SIGTERM,
+		"term":    syscall.SIGTERM,
+		"INT":     syscall.SIGINT,
+		"SigKill": syscall.SIGKILL,
+		"9":       syscall.SIGKILL,
+	} {
+		sig, err := parseSignal(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, sig, s)
+	}
+
+	for _, s := range []string{"FOO", "0", "-1", "100"} {
+		_, err := parseSignal(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestSignalName(t *testing.T) {
+	assert.Equal(t, "SIGTERM", signalName(syscall.SIGTERM))
+	assert.Equal(t, "SIGKILL", signalName(syscall.SIGKILL))
+}
+
+func TestProcessGroupMembers(t *testing.T) {
+	// we're a member of our own process group
+	assert.Contains(t, processGroupMembers(syscall.Getpgrp()), os.Getpid())
+}
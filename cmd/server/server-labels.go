@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validLabelKey and validLabelValue match the keys and values that job
+// labels may have
+var (
+	validLabelKey   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+	validLabelValue = regexp.MustCompile(`^[A-Za-z0-9._/-]{0,128}$`)
+)
+
+// checkLabels makes sure that a command's labels can be selected.
+func checkLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !validLabelKey.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if !validLabelValue.MatchString(value) {
+			return fmt.Errorf("invalid value %q for label %q", value, key)
+		}
+	}
+	return nil
+}
+
+// selectorTerm is one of the comma-separated requirements of a label
+// selector.
+type selectorTerm struct {
+	key   string
+	op    string // "=", "!=", "exists" or "!exists"
+	value string // for "=" and "!="
+}
+
+// labelSelector selects the jobs whose labels meet all of its terms. The
+// empty selector selects every job.
+type labelSelector []selectorTerm
+
+// parseSelector parses a label selector such as "exp=foo,role!=bridge,iter"
+// (or "!iter", for jobs without that label).
+func parseSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		var t selectorTerm
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			t = selectorTerm{key: key, op: "!=", value: value}
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			t = selectorTerm{key: key, op: "=", value: value}
+		} else if key, ok := strings.CutPrefix(term, "!"); ok {
+			t = selectorTerm{key: key, op: "!exists"}
+		} else {
+			t = selectorTerm{key: term, op: "exists"}
+		}
+		if !validLabelKey.MatchString(t.key) || !validLabelValue.MatchString(t.value) {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+// matches reports whether labels meet every term of the selector.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, t := range sel {
+		value, ok := labels[t.key]
+		switch t.op {
+		case "=":
+			if !ok || value != t.value {
+				return false
+			}
+		case "!=":
+			if ok && value == t.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
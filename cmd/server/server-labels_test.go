@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLabels(t *testing.T) {
+	assert.NoError(t, checkLabels(nil))
+	assert.NoError(t, checkLabels(map[string]string{"exp": "foo", "iter": "12", "example.com/role": "bridge", "empty": ""}))
+	assert.Error(t, checkLabels(map[string]string{"": "foo"}))
+	assert.Error(t, checkLabels(map[string]string{"exp=foo": "bar"}))
+	assert.Error(t, checkLabels(map[string]string{"exp": "a,b"}))
+	assert.Error(t, checkLabels(map[string]string{"exp": "has space"}))
+}
+
+func TestLabelSelectors(t *testing.T) {
+	bridge := map[string]string{"exp": "foo", "iter": "12", "role": "bridge", "transport": "obfs"}
+	client := map[string]string{"exp": "foo", "iter": "12", "role": "client"}
+	other := map[string]string{"exp": "bar", "role": "bridge"}
+	unlabelled := map[string]string(nil)
+
+	for _, test := range []struct {
+		selector string
+		matches  []map[string]string
+	}{
+		{"", []map[string]string{bridge, client, other, unlabelled}},
+		{"exp=foo", []map[string]string{bridge, client}},
+		{"exp=foo,role=bridge", []map[string]string{bridge}},
+		{" exp=foo , iter=12 ", []map[string]string{bridge, client}},
+		{"role!=bridge", []map[string]string{client, unlabelled}},
+		{"transport", []map[string]string{bridge}},
+		{"!iter", []map[string]string{other, unlabelled}},
+		{"exp=baz", nil},
+	} {
+		sel, err := parseSelector(test.selector)
+		if !assert.NoError(t, err, test.selector) {
+			continue
+		}
+		var matches []map[string]string
+		for _, labels := range []map[string]string{bridge, client, other, unlabelled} {
+			if sel.matches(labels) {
+				matches = append(matches, labels)
+			}
+		}
+		assert.Equal(t, test.matches, matches, test.selector)
+	}
+
+	for _, selector := range []string{"exp=foo,", "=foo", "exp==foo", "!", "exp=a b"} {
+		_, err := parseSelector(selector)
+		assert.Error(t, err, selector)
+	}
+}
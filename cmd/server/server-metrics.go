@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+)
+
+// metricFamily is a Prometheus counter or histogram, with any number of
+// labels. (Gauges are computed when the metrics are scraped.)
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string // "counter" or "histogram"
+	labels  []string
+	buckets []float64 // upper bounds, for histograms
+
+	series map[string]*metricSeries // keyed by the label values
+}
+
+// metricSeries is the value of a metric family for one set of label values.
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counters
+	counts      []uint64 // histograms: observations in each bucket (not cumulative)
+	sum         float64  // histograms
+	count       uint64   // histograms
+}
+
+// metricsLock protects every metric family
+var metricsLock sync.Mutex
+
+var (
+	jobsStartedMetric = newCounter("webdirector_jobs_started_total",
+		"Jobs started, by endpoint.", "endpoint")
+	jobsExitedMetric = newCounter("webdirector_jobs_exited_total",
+		"Jobs that exited, by endpoint and exit code (or terminating signal).", "endpoint", "exit_code")
+	jobRestartsMetric = newCounter("webdirector_job_restarts_total",
+		"Background jobs restarted by their restart policy.")
+	jobDurationMetric = newHistogram("webdirector_job_duration_seconds",
+		"How long jobs ran for, by endpoint.",
+		[]float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}, "endpoint")
+	httpRequestsMetric = newCounter("webdirector_http_requests_total",
+		"HTTP requests, by route, method and status code.", "route", "method", "code")
+	httpDurationMetric = newHistogram("webdirector_http_request_duration_seconds",
+		"How long HTTP requests took to handle, by route.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "route")
+	uploadBytesMetric = newCounter("webdirector_upload_bytes_total",
+		"Bytes of uploaded files.")
+)
+
+// allMetrics are the metric families, in the order that they're written
+var allMetrics = []*metricFamily{
+	jobsStartedMetric, jobsExitedMetric, jobRestartsMetric, jobDurationMetric,
+	httpRequestsMetric, httpDurationMetric, uploadBytesMetric,
+}
+
+func newCounter(name, help string, labels ...string) *metricFamily {
+	return &metricFamily{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return &metricFamily{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// get returns the series for the label values, creating it if necessary.
+// metricsLock must be held.
+func (m *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to a counter.
+func (m *metricFamily) add(v float64, labelValues ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m.get(labelValues).value += v
+}
+
+// observe adds an observation to a histogram.
+func (m *metricFamily) observe(v float64, labelValues ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	s := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// formatLabels formats label names and values as {name="value",...},
+// escaping the values.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a value as Prometheus expects.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the metric family in the Prometheus text format. metricsLock
+// must be held.
+func (m *metricFamily) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.value))
+			continue
+		}
+		labels := append(append([]string{}, m.labels...), "le")
+		bucket := func(bound string) string {
+			return formatLabels(labels, append(append([]string{}, s.labelValues...), bound))
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucket(formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucket("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+// writeGauge writes a single unlabelled gauge.
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// recordJobStart counts a job started via endpoint.
+func recordJobStart(endpoint string) {
+	jobsStartedMetric.add(1, endpoint)
+}
+
+// recordJobExit counts a job (started via endpoint) that exited after
+// running for the given time.
+func recordJobExit(endpoint string, exit *datamodel.JsonExitStruct, duration time.Duration) {
+	code := strconv.Itoa(exit.ExitCode)
+	if exit.Signal != "" {
+		code = exit.Signal
+	}
+	jobsExitedMetric.add(1, endpoint, code)
+	jobDurationMetric.observe(duration.Seconds(), endpoint)
+}
+
+// recordJobRestart counts a background job that is to be restarted.
+func recordJobRestart() {
+	jobRestartsMetric.add(1)
+}
+
+// routeName returns the path template of the route that matched r, so that
+// requests for (e.g.) different jobs are counted together.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// metricsMiddleware counts requests and how long they took.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			route := routeName(r)
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			httpRequestsMetric.add(1, route, r.Method, strconv.Itoa(status))
+			httpDurationMetric.observe(time.Since(start).Seconds(), route)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// writeProcessMetrics writes the server's own resource usage, using the
+// names of the standard Prometheus client libraries.
+func writeProcessMetrics(w io.Writer) {
+	var rusage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &rusage) == nil {
+		cpu := time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+		fmt.Fprintf(w, "# HELP process_cpu_seconds_total Total user and system CPU time spent in seconds.\n# TYPE process_cpu_seconds_total counter\nprocess_cpu_seconds_total %s\n", formatFloat(cpu.Seconds()))
+	}
+	if b, err := os.ReadFile("/proc/self/statm"); err == nil {
+		// sizes are in pages: total resident ...
+		fields := strings.Fields(string(b))
+		if len(fields) >= 2 {
+			pageSize := float64(os.Getpagesize())
+			virtual, _ := strconv.ParseFloat(fields[0], 64)
+			resident, _ := strconv.ParseFloat(fields[1], 64)
+			writeGauge(w, "process_virtual_memory_bytes", "Virtual memory size in bytes.", virtual*pageSize)
+			writeGauge(w, "process_resident_memory_bytes", "Resident memory size in bytes.", resident*pageSize)
+		}
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		writeGauge(w, "process_open_fds", "Number of open file descriptors.", float64(len(fds)))
+	}
+	writeGauge(w, "process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(serverStartTime.UnixNano())/1e9)
+	writeGauge(w, "go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+}
+
+// serverStartTime is when the server started
+var serverStartTime = time.Now()
+
+// handleMetrics handles the "/metrics" endpoint and reports the server's
+// metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	// (the jobManager's running jobs include those that are pending or
+	// waiting to be restarted)
+	jobListRequestChannel <- filterRunning
+	running := 0
+	for _, job := range <-jobListResponseChannel {
+		if job.State == datamodel.JobRunning {
+			running++
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeGauge(w, "webdirector_jobs_running", "Background jobs that are running.", float64(running))
+	metricsLock.Lock()
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+	metricsLock.Unlock()
+	if cert := certificates.describe(); cert != nil {
+		writeGauge(w, "webdirector_certificate_expiry_timestamp_seconds", "When the server's TLS certificate expires, since unix epoch in seconds.", float64(cert.NotAfter.Unix()))
+	}
+	writeProcessMetrics(w)
+}
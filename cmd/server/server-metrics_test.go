@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricFormat(t *testing.T) {
+	counter := newCounter("test_total", "A test counter.", "route", "code")
+	counter.add(1, "/jobs", "200")
+	counter.add(2, "/jobs", "200")
+	counter.add(1, `/we"ird`, "403")
+
+	histogram := newHistogram("test_seconds", "A test histogram.", []float64{0.5, 1, 5})
+	histogram.observe(0.1)
+	histogram.observe(0.7)
+	histogram.observe(0.9)
+	histogram.observe(30)
+
+	var b strings.Builder
+	counter.write(&b)
+	histogram.write(&b)
+	assert.Equal(t, `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{route="/jobs",code="200"} 3
+test_total{route="/we\"ird",code="403"} 1
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="5"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 31.7
+test_seconds_count 4
+`, b.String())
+}
+
+func TestRecordJobExit(t *testing.T) {
+	recordJobExit("/test", &datamodel.JsonExitStruct{ExitCode: 2}, 3*time.Second)
+	recordJobExit("/test", &datamodel.JsonExitStruct{ExitCode: -1, Signal: "SIGKILL"}, time.Hour)
+
+	var b strings.Builder
+	jobsExitedMetric.write(&b)
+	jobDurationMetric.write(&b)
+	assert.Contains(t, b.String(), `webdirector_jobs_exited_total{endpoint="/test",exit_code="2"} 1`)
+	assert.Contains(t, b.String(), `webdirector_jobs_exited_total{endpoint="/test",exit_code="SIGKILL"} 1`)
+	assert.Contains(t, b.String(), `webdirector_job_duration_seconds_bucket{endpoint="/test",le="10"} 1`)
+	assert.Contains(t, b.String(), `webdirector_job_duration_seconds_bucket{endpoint="/test",le="3600"} 2`)
+}
+
+func TestHandleMetricsRunningJobs(t *testing.T) {
+	// (answering in place of the jobManager)
+	go func() {
+		<-jobListRequestChannel
+		jobListResponseChannel <- jobList{
+			{JobNo: 1, State: datamodel.JobRunning},
+			{JobNo: 2, State: datamodel.JobPending},
+			{JobNo: 3, State: datamodel.JobRestarting},
+			{JobNo: 4, State: datamodel.JobRunning},
+		}
+	}()
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "\nwebdirector_jobs_running 2\n")
+}
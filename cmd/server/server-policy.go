@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	"datamodel"
+)
+
+// commandEndpoints are the endpoints that run commands, and hence are subject
+// to the policy
+var commandEndpoints = []string{"/runToCompletion", "/runInBackground"}
+
+// policyRule allows a single executable to be run.
+type policyRule struct {
+	// Cmd is the executable, either as an absolute path or as a name to be
+	// looked up in the server's PATH
+	Cmd string `json:"cmd"`
+	// Args are regular expressions; every argument must (fully) match at
+	// least one of them. With no regular expressions, no arguments are
+	// allowed.
+	Args []string `json:"args"`
+	// Endpoints that the rule applies to; all of commandEndpoints if empty
+	Endpoints []string `json:"endpoints"`
+	// AllowEnv permits requests to change the command's environment (which
+	// could otherwise be used to subvert it, e.g. via LD_PRELOAD)
+	AllowEnv bool `json:"allowEnv"`
+	// RunAs lists the users (other than the server's own) that requests may
+	// run the command as, e.g. "root" for commands that need to be elevated
+	RunAs []string `json:"runAs"`
+
+	path string           // resolved executable
+	args []*regexp.Regexp // compiled Args
+}
+
+// policy is the set of commands that clients are allowed to run. A nil
+// *policy allows everything.
+type policy struct {
+	Rules []*policyRule `json:"rules"`
+}
+
+// commandPolicy is the policy loaded at startup, if any
+var commandPolicy *policy
+
+// resolveExecutable returns the absolute path of an executable (following
+// symbolic links, if possible). Names without a path separator are looked up
+// in the server's PATH; relative paths are relative to dir.
+func resolveExecutable(name, dir string) (string, error) {
+	path := name
+	if filepath.Base(name) == name {
+		var err error
+		if path, err = exec.LookPath(name); err != nil {
+			return "", err
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	return filepath.Clean(path), nil
+}
+
+// loadPolicy reads and checks a policy file.
+func loadPolicy(fileName string) (*policy, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var p policy
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range p.Rules {
+		if rule.Cmd == "" {
+			return nil, fmt.Errorf("%s: rule %d has no cmd", fileName, i)
+		}
+		if rule.path, err = resolveExecutable(rule.Cmd, cwd); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %v", fileName, i, err)
+		}
+		for _, arg := range rule.Args {
+			re, err := regexp.Compile("^(?:" + arg + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %v", fileName, i, err)
+			}
+			rule.args = append(rule.args, re)
+		}
+		for _, endpoint := range rule.Endpoints {
+			if !contains(commandEndpoints, endpoint) {
+				return nil, fmt.Errorf("%s: rule %d: unknown endpoint %q", fileName, i, endpoint)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error explaining why cmd (as requested by c) may not be
+// run via endpoint, or nil if it may. Without a policy, commands may only
+// run as the server's own user.
+func (p *policy) check(endpoint string, cmd *exec.Cmd, c datamodel.JsonCommandStruct) error {
+	otherUser := c.User != "" && c.User != serverUser
+	if p == nil {
+		if otherUser {
+			return fmt.Errorf("command %q may not run as %q without a policy", c.Cmd, c.User)
+		}
+		return nil
+	}
+	path, err := resolveExecutable(cmd.Path, cmd.Dir)
+	if err != nil {
+		return fmt.Errorf("command %q not allowed by policy: %v", c.Cmd, err)
+	}
+
+	// the reason that the closest matching rule rejected the command
+	reason := fmt.Errorf("command %q not allowed by policy", c.Cmd)
+	for _, rule := range p.Rules {
+		if rule.path != path {
+			continue
+		}
+		if len(rule.Endpoints) > 0 && !contains(rule.Endpoints, endpoint) {
+			reason = fmt.Errorf("command %q not allowed via %s", c.Cmd, endpoint)
+			continue
+		}
+		if (len(c.Env) > 0 || c.ClearEnv) && !rule.AllowEnv {
+			reason = fmt.Errorf("command %q may not change its environment", c.Cmd)
+			continue
+		}
+		if otherUser && !contains(rule.RunAs, c.User) {
+			reason = fmt.Errorf("command %q may not run as %q", c.Cmd, c.User)
+			continue
+		}
+		if err := rule.checkArgs(c.Args); err != nil {
+			reason = fmt.Errorf("command %q: %v", c.Cmd, err)
+			continue
+		}
+		return nil
+	}
+	return reason
+}
+
+// checkArgs makes sure that every argument matches one of the rule's
+// regular expressions.
+func (rule *policyRule) checkArgs(args []string) error {
+	for i, arg := range args {
+		allowed := false
+		for _, re := range rule.args {
+			if re.MatchString(arg) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("argument %d (%q) not allowed by policy", i+1, arg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `{
+  "rules": [
+    {"cmd": "echo", "args": ["[a-z]+", "-n"]},
+    {"cmd": "sleep", "args": ["[0-9]+"], "endpoints": ["/runInBackground"]},
+    {"cmd": "env", "allowEnv": true},
+    {"cmd": "id", "runAs": ["root"]}
+  ]
+}`
+
+func checkTestPolicy(t *testing.T, p *policy, endpoint string, c datamodel.JsonCommandStruct) error {
+	cmd := exec.Command(c.Cmd, c.Args...)
+	cmd.Dir = t.TempDir()
+	return p.check(endpoint, cmd, c)
+}
+
+func TestPolicy(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "policy.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(testPolicy), 0644))
+	p, err := loadPolicy(fileName)
+	assert.NoError(t, err)
+
+	for _, c := range []datamodel.JsonCommandStruct{
+		{Cmd: "echo"},
+		{Cmd: "echo", Args: []string{"-n", "hello"}},
+		{Cmd: "sleep", Args: []string{"5"}},
+		{Cmd: "env", Env: map[string]string{"FOO": "bar"}},
+		{Cmd: "id", User: "root"},
+		{Cmd: "echo", User: serverUser},
+	} {
+		assert.NoError(t, checkTestPolicy(t, p, "/runInBackground", c), c)
+	}
+
+	for _, c := range []datamodel.JsonCommandStruct{
+		// not in the policy
+		{Cmd: "cat", Args: []string{"/etc/passwd"}},
+		// arguments must match completely
+		{Cmd: "echo", Args: []string{"hello world"}},
+		{Cmd: "echo", Args: []string{"hello", "-e"}},
+		// no arguments are allowed unless there are regular expressions
+		{Cmd: "env", Args: []string{"sh"}},
+		// changing the environment must be allowed explicitly
+		{Cmd: "echo", Args: []string{"hi"}, Env: map[string]string{"LD_PRELOAD": "evil.so"}},
+		{Cmd: "echo", ClearEnv: true},
+		// other users must be allowed explicitly
+		{Cmd: "echo", User: "root"},
+		{Cmd: "id", User: "daemon"},
+	} {
+		assert.Error(t, checkTestPolicy(t, p, "/runInBackground", c), c)
+	}
+
+	// sleep is only allowed in the background
+	assert.Error(t, checkTestPolicy(t, p, "/runToCompletion", datamodel.JsonCommandStruct{Cmd: "sleep", Args: []string{"5"}}))
+
+	// the nil policy allows everything
+	var none *policy
+	assert.NoError(t, checkTestPolicy(t, none, "/runToCompletion", datamodel.JsonCommandStruct{Cmd: "cat"}))
+	// ... except running as other users
+	assert.Error(t, checkTestPolicy(t, none, "/runToCompletion", datamodel.JsonCommandStruct{Cmd: "cat", User: "daemon"}))
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	for _, s := range []string{
+		`{"rules": [{"args": ["x"]}]}`,
+		`{"rules": [{"cmd": "echo", "args": ["("]}]}`,
+		`{"rules": [{"cmd": "echo", "endpoints": ["/exit"]}]}`,
+		`{"rules": [{"cmd": "no-such-command-exists"}]}`,
+		`not json`,
+	} {
+		fileName := filepath.Join(t.TempDir(), "policy.json")
+		assert.NoError(t, os.WriteFile(fileName, []byte(s), 0644))
+		_, err := loadPolicy(fileName)
+		assert.Error(t, err, s)
+	}
+}
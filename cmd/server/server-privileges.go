@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/user"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Linux capabilities that the privileged thread keeps after the server has
+// dropped its privileges, so that it can start jobs as other users, signal
+// them, and reload the server's certificate (whose key is usually only
+// readable by root)
+const (
+	capDacReadSearch = 2
+	capKill          = 5
+	capSetgid        = 6
+	capSetuid        = 7
+
+	prSetKeepcaps           = 8
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// serverUser is the name of the user that the server runs as
+var serverUser string
+
+// privilegedChannel sends functions to be run on the privileged thread
+var privilegedChannel chan func()
+
+// privilegedThread runs functions that start or signal jobs (or read the
+// server's certificate). It's locked to
+// an OS thread, which is the only one that keeps any capabilities once the
+// server has dropped its privileges (see dropPrivileges). (Capabilities are a
+// property of threads, and the Go runtime doesn't clone new threads from
+// locked ones.)
+func privilegedThread(ready chan<- struct{}) {
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetKeepcaps, 1, 0); errno != 0 {
+		log.Printf("warning: cannot keep capabilities: %v", errno)
+	}
+	ready <- struct{}{}
+	for f := range privilegedChannel {
+		f()
+	}
+}
+
+// startPrivilegedThread starts the privileged thread. It must be called
+// before dropPrivileges.
+func startPrivilegedThread() {
+	privilegedChannel = make(chan func())
+	ready := make(chan struct{})
+	go privilegedThread(ready)
+	<-ready
+}
+
+// runPrivileged runs f on the privileged thread (or directly, if there isn't
+// one).
+func runPrivileged(f func() error) error {
+	if privilegedChannel == nil {
+		return f()
+	}
+	done := make(chan error)
+	privilegedChannel <- func() { done <- f() }
+	return <-done
+}
+
+// dropPrivileges makes the whole server run as the named user (and its
+// groups), except that the privileged thread keeps the capabilities needed
+// to start jobs as other users, to signal them and to reload the certificate.
+func dropPrivileges(username string) error {
+	cred, err := lookupCredential(username)
+	if err != nil {
+		return err
+	}
+	// these apply to every thread
+	if err := syscall.Setgroups(intsFromUint32s(cred.Groups)); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setresgid(int(cred.Gid), int(cred.Gid), int(cred.Gid)); err != nil {
+		return fmt.Errorf("setresgid: %v", err)
+	}
+	if err := syscall.Setresuid(int(cred.Uid), int(cred.Uid), int(cred.Uid)); err != nil {
+		return fmt.Errorf("setresuid: %v", err)
+	}
+
+	// the privileged thread still has its permitted capabilities (thanks to
+	// PR_SET_KEEPCAPS); keep the ones we need, and make them effective
+	err = runPrivileged(func() error {
+		caps := uint32(1<<capDacReadSearch | 1<<capKill | 1<<capSetgid | 1<<capSetuid)
+		header := capHeader{version: linuxCapabilityVersion3}
+		data := [2]capData{{effective: caps, permitted: caps}}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("capset: %v", errno)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("warning: jobs can only run as %s: %v", username, err)
+	}
+
+	// make sure that there's no way back (on this thread, which isn't the
+	// privileged one; syscall.Setuid would try every thread)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETUID, 0, 0, 0); errno == 0 {
+		return errors.New("could still become root after dropping privileges")
+	}
+	serverUser = username
+	return nil
+}
+
+// lookupCredential returns the uid, gid and supplementary groups of a user.
+func lookupCredential(username string) (*syscall.Credential, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groupIds {
+		if n, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(n))
+		}
+	}
+	return cred, nil
+}
+
+func intsFromUint32s(u []uint32) []int {
+	ints := make([]int, len(u))
+	for i := range u {
+		ints[i] = int(u[i])
+	}
+	return ints
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupCredential(t *testing.T) {
+	cred, err := lookupCredential("root")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), cred.Uid)
+	assert.Equal(t, uint32(0), cred.Gid)
+	assert.Contains(t, cred.Groups, uint32(0))
+
+	_, err = lookupCredential("no-such-user-hopefully")
+	assert.Error(t, err)
+}
+
+func TestRunPrivileged(t *testing.T) {
+	defer func() { privilegedChannel = nil }()
+	errTest := errors.New("test")
+
+	// without the privileged thread, functions run directly
+	assert.Equal(t, errTest, runPrivileged(func() error { return errTest }))
+
+	startPrivilegedThread()
+	ran := false
+	assert.NoError(t, runPrivileged(func() error { ran = true; return nil }))
+	assert.True(t, ran)
+	assert.Equal(t, errTest, runPrivileged(func() error { return errTest }))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"datamodel"
+)
+
+// defaultReadyTimeout is how long "/runInBackground" waits for a job to be
+// ready, unless its command says otherwise
+const defaultReadyTimeout = 30 * time.Second
+
+// readyPollInterval is how often we check whether a job is ready
+const readyPollInterval = 100 * time.Millisecond
+
+// readyOutputTail is how much of the end of a job's stdout and stderr is
+// reported if it doesn't become ready
+const readyOutputTail = 4 * 1024
+
+// readyCondition is a command's readiness conditions (see
+// datamodel.JsonReadyWhenStruct), as checked while waiting for a job.
+type readyCondition struct {
+	datamodel.JsonReadyWhenStruct
+	output *regexp.Regexp
+	// matched is set once the output has matched, so that it still counts
+	// once it's no longer in the job's ring buffers
+	matched bool
+}
+
+// newReadyCondition checks a command's readiness conditions, compiling its
+// regular expression and resolving its file (relative to dir, and inside
+// root; see resolveInWorkspace).
+func newReadyCondition(rw datamodel.JsonReadyWhenStruct, root, dir string) (*readyCondition, error) {
+	if rw.Port == 0 && rw.Output == "" && rw.File == "" {
+		return nil, errors.New("readyWhen needs a port, an output pattern or a file")
+	}
+	if rw.Port < 0 || rw.Port > 65535 {
+		return nil, fmt.Errorf("invalid readyWhen port %d", rw.Port)
+	}
+	if rw.TimeoutInSecs < 0 {
+		return nil, errors.New("readyWhen timeout must not be negative")
+	}
+	rc := &readyCondition{JsonReadyWhenStruct: rw}
+	var err error
+	if rw.Output != "" {
+		if rc.output, err = regexp.Compile(rw.Output); err != nil {
+			return nil, fmt.Errorf("invalid readyWhen output pattern: %v", err)
+		}
+	}
+	if rw.File != "" {
+		if rc.File, err = resolveInWorkspace(root, dir, rw.File); err != nil {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// tcpListening reports whether any process is listening on a TCP port (on
+// any address), according to /proc/net/tcp and /proc/net/tcp6.
+func tcpListening(port int) bool {
+	for _, proto := range []string{"tcp", "tcp6"} {
+		sockets, _ := readProcFile("/proc/net/"+proto, func(r io.Reader) ([]datamodel.JsonSocketStruct, error) {
+			return parseListeningTCP(r, proto)
+		})
+		for _, socket := range sockets {
+			if socket.Port == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// outputMatches reports whether the output still in a ring buffer matches re.
+func outputMatches(rb *datamodel.RingBuffer, re *regexp.Regexp) bool {
+	data, _, _, _ := rb.Snapshot(0)
+	return re.Match(data)
+}
+
+// pending returns the conditions that don't hold yet for job p, or nil if
+// it's ready.
+func (rc *readyCondition) pending(p *datamodel.ProcessJobStruct) []string {
+	var pending []string
+	if rc.Port != 0 && !tcpListening(rc.Port) {
+		pending = append(pending, fmt.Sprintf("port %d to be listened on", rc.Port))
+	}
+	if rc.output != nil && !rc.matched {
+		if rc.matched = outputMatches(p.Stdout, rc.output) || outputMatches(p.Stderr, rc.output); !rc.matched {
+			pending = append(pending, fmt.Sprintf("output matching %q", rc.Output))
+		}
+	}
+	if rc.File != "" {
+		if _, err := os.Stat(rc.File); err != nil {
+			pending = append(pending, rc.File+" to exist")
+		}
+	}
+	return pending
+}
+
+// waitUntilReady waits (checking every readyPollInterval) until a job that has
+// just been started is ready. It fails if the job's process (pid, which
+// started at startTicks) exits first, or if the job isn't ready in time.
+func waitUntilReady(p *datamodel.ProcessJobStruct, rc *readyCondition, pid int, startTicks uint64) error {
+	timeout := defaultReadyTimeout
+	if rc.TimeoutInSecs > 0 {
+		timeout = secondsToDuration(rc.TimeoutInSecs)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := rc.pending(p)
+		switch {
+		case len(pending) == 0:
+			return nil
+		case !processAlive(pid, startTicks):
+			return fmt.Errorf("job %v exited before it was ready (waiting for %s)", p.JobNo, strings.Join(pending, " and "))
+		case time.Now().After(deadline):
+			return fmt.Errorf("job %v wasn't ready after %v (waiting for %s)", p.JobNo, timeout, strings.Join(pending, " and "))
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
+// abandonJob kills a job that didn't become ready (so that it isn't
+// restarted either), and returns err along with the end of the job's output.
+func abandonJob(p *datamodel.ProcessJobStruct, err error) error {
+	log.Printf("%v, killing it", err)
+	killJobs(func(q *datamodel.ProcessJobStruct) bool { return q == p }, syscall.SIGTERM, defaultKillGrace)
+	// wait for the rest of its output
+	select {
+	case <-p.Done:
+	case <-time.After(defaultKillGrace):
+	}
+
+	var b strings.Builder
+	b.WriteString(err.Error())
+	for _, out := range []struct {
+		name string
+		rb   *datamodel.RingBuffer
+	}{{"stdout", p.Stdout}, {"stderr", p.Stderr}} {
+		data, _, _, _ := out.rb.Snapshot(0)
+		if len(data) > readyOutputTail {
+			data = data[len(data)-readyOutputTail:]
+		}
+		fmt.Fprintf(&b, "\n%s:\n%s", out.name, data)
+	}
+	return errors.New(b.String())
+}
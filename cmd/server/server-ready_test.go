@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReadyCondition(t *testing.T) {
+	root := t.TempDir()
+	rc, err := newReadyCondition(datamodel.JsonReadyWhenStruct{Port: 8080, Output: "listening on .*", File: "ready"}, root, root)
+	if assert.NoError(t, err) {
+		assert.Equal(t, filepath.Join(root, "ready"), rc.File)
+		assert.NotNil(t, rc.output)
+	}
+
+	for _, rw := range []datamodel.JsonReadyWhenStruct{
+		{},
+		{TimeoutInSecs: 5},
+		{Port: 70000},
+		{Port: 8080, TimeoutInSecs: -1},
+		{Output: "("},
+		{File: "../ready"},
+		{File: "/tmp/ready"},
+	} {
+		_, err := newReadyCondition(rw, root, root)
+		assert.Error(t, err, "%+v", rw)
+	}
+}
+
+func TestTCPListening(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	assert.True(t, tcpListening(port))
+	l.Close()
+	assert.False(t, tcpListening(port))
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	ticks, err := processStartTicks(os.Getpid())
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	newJob := func() *datamodel.ProcessJobStruct {
+		return &datamodel.ProcessJobStruct{
+			Stdout:        datamodel.NewRingBuffer(64),
+			Stderr:        datamodel.NewRingBuffer(64),
+			JsonJobStruct: datamodel.JsonJobStruct{JobNo: 1},
+		}
+	}
+
+	// the job is ready once its output has matched and the file exists
+	p := newJob()
+	rc, err := newReadyCondition(datamodel.JsonReadyWhenStruct{Output: "ready", File: "ready"}, dir, dir)
+	assert.NoError(t, err)
+	go func() {
+		p.Stderr.Write([]byte("ready\n"))
+		time.Sleep(2 * readyPollInterval)
+		// (the match still counts once it's out of the ring buffer)
+		p.Stderr.Write(make([]byte, 100))
+		os.WriteFile(filepath.Join(dir, "ready"), nil, 0666)
+	}()
+	assert.NoError(t, waitUntilReady(p, rc, os.Getpid(), ticks))
+
+	// it fails if it isn't ready in time, or if its process exits first
+	rc, err = newReadyCondition(datamodel.JsonReadyWhenStruct{Output: "ready", TimeoutInSecs: 0.25}, dir, dir)
+	assert.NoError(t, err)
+	assert.EqualError(t, waitUntilReady(newJob(), rc, os.Getpid(), ticks), `job 1 wasn't ready after 250ms (waiting for output matching "ready")`)
+	rc, err = newReadyCondition(datamodel.JsonReadyWhenStruct{Output: "ready"}, dir, dir)
+	assert.NoError(t, err)
+	assert.EqualError(t, waitUntilReady(newJob(), rc, os.Getpid(), ticks+1), `job 1 exited before it was ready (waiting for output matching "ready")`)
+}
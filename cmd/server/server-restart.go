@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"datamodel"
+)
+
+// defaultRestartBackoff is how long a job waits to be restarted the first
+// time, unless its command says otherwise
+const defaultRestartBackoff = time.Second
+
+// maxRestartBackoff is the longest that a job waits to be restarted, however
+// often it has failed
+const maxRestartBackoff = 5 * time.Minute
+
+// restartResetAfter is how long a job must have run for before exiting for its
+// restart delay to go back to the initial one
+const restartResetAfter = 10 * time.Minute
+
+// checkRestartPolicy checks the restart policy of a command.
+func checkRestartPolicy(c datamodel.JsonCommandStruct) error {
+	switch c.Restart {
+	case "", datamodel.RestartNever, datamodel.RestartOnFailure, datamodel.RestartAlways:
+	default:
+		return fmt.Errorf("restart must be one of %s, %s or %s", datamodel.RestartNever, datamodel.RestartOnFailure, datamodel.RestartAlways)
+	}
+	if c.MaxRestarts < 0 || c.RestartBackoffInSecs < 0 {
+		return errors.New("maxRestarts and restartBackoff must not be negative")
+	}
+	return nil
+}
+
+// failureReason describes how a job's process failed, or returns "" if it
+// exited successfully.
+func failureReason(p *datamodel.ProcessJobStruct) string {
+	switch {
+	case p.Exit.Signal != "":
+		return "killed by " + p.Exit.Signal
+	case p.Cmd == nil:
+		// an adopted job
+		return "exited with an unknown exit code"
+	case p.Exit.ExitCode != 0:
+		return fmt.Sprintf("exit code %d", p.Exit.ExitCode)
+	}
+	return ""
+}
+
+// restartDelay reports whether a job whose process has exited (see
+// recordExit), or couldn't be restarted, should be restarted according to its
+// command's restart policy, and if so, after how long. failure says how the
+// process failed ("" if it didn't).
+func restartDelay(p *datamodel.ProcessJobStruct, failure string) (time.Duration, bool) {
+	c := p.Command
+	switch {
+	case p.Killed || p.TimedOut:
+		// it was stopped on purpose
+		return 0, false
+	case c.Restart == datamodel.RestartAlways:
+	case c.Restart == datamodel.RestartOnFailure && failure != "":
+	default:
+		return 0, false
+	}
+	if c.MaxRestarts > 0 && p.Restarts >= c.MaxRestarts {
+		log.Printf("Job %v has been restarted %d times already, giving up: %v", p.JobNo, p.Restarts, p.CmdLine)
+		return 0, false
+	}
+
+	// the delay doubles with each restart, unless the job had been running
+	// for a while
+	initial := defaultRestartBackoff
+	if c.RestartBackoffInSecs > 0 {
+		initial = secondsToDuration(c.RestartBackoffInSecs)
+	}
+	ran := time.Duration(0)
+	if p.Exit != nil {
+		ran = p.Exit.EndTime.Sub(p.StartTime)
+	}
+	if p.RestartBackoff == 0 || ran >= restartResetAfter {
+		p.RestartBackoff = initial
+	} else if p.RestartBackoff < maxRestartBackoff {
+		p.RestartBackoff *= 2
+		if p.RestartBackoff > maxRestartBackoff {
+			p.RestartBackoff = maxRestartBackoff
+		}
+	}
+	return p.RestartBackoff, true
+}
+
+// restartAfter waits for delay, and then asks the jobManager to restart a
+// job. If the job is killed first, it gives up.
+func restartAfter(p *datamodel.ProcessJobStruct, delay time.Duration) {
+	log.Printf("Restarting job %v in %v: %v", p.JobNo, delay, p.CmdLine)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		jobLaunchChannel <- jobLaunch{p: p, due: time.Now()}
+	case <-p.Done:
+	}
+}
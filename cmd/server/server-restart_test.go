@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRestartPolicy(t *testing.T) {
+	assert.NoError(t, checkRestartPolicy(datamodel.JsonCommandStruct{}))
+	assert.NoError(t, checkRestartPolicy(datamodel.JsonCommandStruct{Restart: datamodel.RestartOnFailure, MaxRestarts: 3, RestartBackoffInSecs: 0.5}))
+	assert.Error(t, checkRestartPolicy(datamodel.JsonCommandStruct{Restart: "sometimes"}))
+	assert.Error(t, checkRestartPolicy(datamodel.JsonCommandStruct{Restart: datamodel.RestartAlways, MaxRestarts: -1}))
+}
+
+func TestFailureReason(t *testing.T) {
+	cmd := &exec.Cmd{}
+	exited := func(exit datamodel.JsonExitStruct) *datamodel.ProcessJobStruct {
+		return &datamodel.ProcessJobStruct{Cmd: cmd, JsonJobStruct: datamodel.JsonJobStruct{Exit: &exit}}
+	}
+	assert.Equal(t, "", failureReason(exited(datamodel.JsonExitStruct{})))
+	assert.Equal(t, "exit code 2", failureReason(exited(datamodel.JsonExitStruct{ExitCode: 2})))
+	assert.Equal(t, "killed by SIGKILL", failureReason(exited(datamodel.JsonExitStruct{ExitCode: -1, Signal: "SIGKILL"})))
+
+	adopted := exited(datamodel.JsonExitStruct{ExitCode: -1})
+	adopted.Cmd = nil
+	assert.Equal(t, "exited with an unknown exit code", failureReason(adopted))
+}
+
+func TestRestartDelay(t *testing.T) {
+	start := time.Now()
+	job := func(c datamodel.JsonCommandStruct, ran time.Duration) *datamodel.ProcessJobStruct {
+		return &datamodel.ProcessJobStruct{
+			Command: c,
+			JsonJobStruct: datamodel.JsonJobStruct{
+				StartTime: start,
+				Exit:      &datamodel.JsonExitStruct{EndTime: start.Add(ran)},
+			},
+		}
+	}
+
+	// the policy decides whether successful and failed jobs are restarted
+	_, ok := restartDelay(job(datamodel.JsonCommandStruct{}, time.Second), "exit code 1")
+	assert.False(t, ok)
+	_, ok = restartDelay(job(datamodel.JsonCommandStruct{Restart: datamodel.RestartOnFailure}, time.Second), "")
+	assert.False(t, ok)
+	delay, ok := restartDelay(job(datamodel.JsonCommandStruct{Restart: datamodel.RestartOnFailure}, time.Second), "exit code 1")
+	assert.True(t, ok)
+	assert.Equal(t, defaultRestartBackoff, delay)
+	_, ok = restartDelay(job(datamodel.JsonCommandStruct{Restart: datamodel.RestartAlways}, time.Second), "")
+	assert.True(t, ok)
+
+	// jobs that were killed, or timed out, aren't restarted
+	p := job(datamodel.JsonCommandStruct{Restart: datamodel.RestartAlways}, time.Second)
+	p.Killed = true
+	_, ok = restartDelay(p, "killed by SIGTERM")
+	assert.False(t, ok)
+	p = job(datamodel.JsonCommandStruct{Restart: datamodel.RestartAlways}, time.Second)
+	p.TimedOut = true
+	_, ok = restartDelay(p, "killed by SIGTERM")
+	assert.False(t, ok)
+
+	// the delay doubles, up to a limit, until the job runs for a while
+	p = job(datamodel.JsonCommandStruct{Restart: datamodel.RestartAlways, RestartBackoffInSecs: 60}, time.Second)
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, maxRestartBackoff, maxRestartBackoff} {
+		delay, ok = restartDelay(p, "")
+		assert.True(t, ok)
+		assert.Equal(t, want, delay)
+		p.Restarts++
+	}
+	p.Exit.EndTime = start.Add(restartResetAfter)
+	delay, _ = restartDelay(p, "")
+	assert.Equal(t, time.Minute, delay)
+
+	// and the job is only restarted so many times
+	p = job(datamodel.JsonCommandStruct{Restart: datamodel.RestartAlways, MaxRestarts: 2}, time.Second)
+	p.Restarts = 1
+	_, ok = restartDelay(p, "")
+	assert.True(t, ok)
+	p.Restarts = 2
+	_, ok = restartDelay(p, "")
+	assert.False(t, ok)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"datamodel"
+)
+
+// jobLaunch asks the jobManager to start a pending job that is now due (or,
+// if err is set, to mark it as failed).
+type jobLaunch struct {
+	p   *datamodel.ProcessJobStruct
+	due time.Time
+	err error
+}
+
+var jobLaunchChannel = make(chan jobLaunch)
+
+// lookupDependency returns the job with the given number, which a new job is
+// to start after. It must not have finished.
+func lookupDependency(jobNo datamodel.JobNoType) (*datamodel.ProcessJobStruct, error) {
+	jobLookupChannel <- jobNo
+	p := <-jobLookupResponseChannel
+	if p == nil {
+		return nil, fmt.Errorf("no such job %v to start after", jobNo)
+	}
+	select {
+	case <-p.Done:
+		return nil, fmt.Errorf("job %v, to start after, has already finished", jobNo)
+	default:
+		return p, nil
+	}
+}
+
+// holdJob waits until a pending job is due: once the job that it starts after
+// (if any) has started, and its start time (if any) has come. It then asks the
+// jobManager to start it. If the job is canceled first, it gives up; if the
+// job it starts after finishes without having started, the job fails.
+func holdJob(p *datamodel.ProcessJobStruct, after *datamodel.ProcessJobStruct) {
+	log.Printf("Holding job %v: %v", p.JobNo, p.CmdLine)
+	var due time.Time
+	if after != nil {
+		select {
+		case <-after.Started:
+		case <-after.Done:
+		case <-p.Done:
+			return
+		}
+		select {
+		case <-after.Started:
+			due = time.Now()
+		default:
+			jobLaunchChannel <- jobLaunch{p: p, err: fmt.Errorf("job %v finished without starting", after.JobNo)}
+			return
+		}
+	}
+	if startAt := p.Command.StartAt; startAt != nil && startAt.After(due) {
+		due = *startAt
+		timer := time.NewTimer(time.Until(due))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.Done:
+			return
+		}
+	}
+	jobLaunchChannel <- jobLaunch{p: p, due: due}
+}
+
+// rescheduleJob holds a pending job restored from the state file again (see
+// holdJob), after finding the job it starts after, if any.
+func rescheduleJob(p *datamodel.ProcessJobStruct) {
+	var after *datamodel.ProcessJobStruct
+	if jobNo := p.Command.StartAfterJob; jobNo != nil {
+		jobLookupChannel <- *jobNo
+		if after = <-jobLookupResponseChannel; after == nil {
+			jobLaunchChannel <- jobLaunch{p: p, err: fmt.Errorf("job %v, to start after, has been forgotten", *jobNo)}
+			return
+		}
+	}
+	holdJob(p, after)
+}
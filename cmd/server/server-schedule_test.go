@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPendingJob(jobNo datamodel.JobNoType, c datamodel.JsonCommandStruct) *datamodel.ProcessJobStruct {
+	return &datamodel.ProcessJobStruct{
+		Command:       c,
+		Started:       make(chan struct{}),
+		Done:          make(chan struct{}),
+		JsonJobStruct: datamodel.JsonJobStruct{JobNo: jobNo, State: datamodel.JobPending},
+	}
+}
+
+// nextLaunch returns the next launch request sent by holdJob, or nil if there
+// isn't one within timeout.
+func nextLaunch(timeout time.Duration) *jobLaunch {
+	select {
+	case l := <-jobLaunchChannel:
+		return &l
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestHoldJobUntilStartAt(t *testing.T) {
+	startAt := time.Now().Add(100 * time.Millisecond)
+	p := newPendingJob(1, datamodel.JsonCommandStruct{StartAt: &startAt})
+	go holdJob(p, nil)
+
+	l := nextLaunch(time.Second)
+	if assert.NotNil(t, l) {
+		assert.False(t, time.Now().Before(startAt))
+		assert.Same(t, p, l.p)
+		assert.True(t, startAt.Equal(l.due))
+		assert.NoError(t, l.err)
+	}
+}
+
+func TestHoldJobUntilAfterJobStarts(t *testing.T) {
+	after := newPendingJob(1, datamodel.JsonCommandStruct{})
+	p := newPendingJob(2, datamodel.JsonCommandStruct{})
+	go holdJob(p, after)
+	assert.Nil(t, nextLaunch(50*time.Millisecond), "job 1 hasn't started")
+
+	close(after.Started)
+	l := nextLaunch(time.Second)
+	if assert.NotNil(t, l) {
+		assert.NoError(t, l.err)
+		assert.WithinDuration(t, time.Now(), l.due, time.Second)
+	}
+
+	// a job that starts after one that never starts fails
+	after = newPendingJob(3, datamodel.JsonCommandStruct{})
+	p = newPendingJob(4, datamodel.JsonCommandStruct{})
+	go holdJob(p, after)
+	close(after.Done)
+	l = nextLaunch(time.Second)
+	if assert.NotNil(t, l) {
+		assert.EqualError(t, l.err, "job 3 finished without starting")
+	}
+}
+
+func TestHoldJobCanceled(t *testing.T) {
+	startAt := time.Now().Add(time.Hour)
+	p := newPendingJob(1, datamodel.JsonCommandStruct{StartAt: &startAt})
+	held := make(chan struct{})
+	go func() {
+		holdJob(p, nil)
+		close(held)
+	}()
+	close(p.Done)
+	select {
+	case <-held:
+	case <-time.After(time.Second):
+		t.Fatal("holdJob didn't give up on a canceled job")
+	}
+	assert.Nil(t, nextLaunch(50*time.Millisecond))
+}
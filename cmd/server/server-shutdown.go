@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"datamodel"
+)
+
+// shutdownTimeout is how long in-flight requests (and, unless they are kept,
+// jobs) are given to finish when the server shuts down
+var shutdownTimeout = 30 * time.Second
+
+// shuttingDown is closed once the server has started to shut down
+var shuttingDown = make(chan struct{})
+
+// shutdownChannel receives requests to shut down from "/exit"
+var shutdownChannel = make(chan datamodel.JsonShutdownStruct, 1)
+
+// jobFlushChannel asks the jobManager to save its job table, closing the
+// given channel once it has
+var jobFlushChannel = make(chan chan struct{})
+
+// newWorkRoutes are the routes that are refused once the server has started
+// to shut down
+var newWorkRoutes = map[string]bool{
+	"/exit":            true,
+	"/runToCompletion": true,
+	"/runInBackground": true,
+	"/upload":          true,
+}
+
+// isShuttingDown reports whether the server has started to shut down.
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownMiddleware refuses requests that would start new work once the
+// server has started to shut down.
+func shutdownMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isShuttingDown() && newWorkRoutes[routeName(r)] {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleExit handles the "/exit" endpoint and shuts the server down (see
+// shutdown), once this request has been answered. The request body, if any,
+// says what to do with the jobs.
+func handleExit(w http.ResponseWriter, r *http.Request) {
+	var opts datamodel.JsonShutdownStruct
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseSignal(opts.Signal); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case shutdownChannel <- opts:
+	default:
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(true, w)
+}
+
+// waitForJobs waits up to timeout for the jobManager to have no running jobs,
+// and reports whether it did.
+func waitForJobs(timeout time.Duration) bool {
+	return waitForExit(func() []int {
+		jobListRequestChannel <- filterRunning
+		running := make([]int, 0)
+		for _, job := range <-jobListResponseChannel {
+			running = append(running, job.Pid)
+		}
+		return running
+	}, timeout)
+}
+
+// shutdown shuts the server down gracefully: it stops accepting new work,
+// kills the jobs (unless they are to be kept), waits for in-flight requests to
+// finish (for up to shutdownTimeout), and saves the job table and the audit
+// log.
+func shutdown(server *http.Server, opts datamodel.JsonShutdownStruct) {
+	close(shuttingDown)
+
+	if opts.KeepJobs {
+		log.Println("Leaving jobs running")
+	} else {
+		// (the signal was checked by handleExit)
+		sig, _ := parseSignal(opts.Signal)
+		grace := defaultKillGrace
+		if opts.GraceInSecs > 0 {
+			grace = secondsToDuration(opts.GraceInSecs)
+		}
+		log.Printf("Killing all jobs with %v", signalName(sig))
+		killJobs(jobNumbered(-1), sig, grace)
+		// the jobs' exits still have to reach the jobManager
+		if !waitForJobs(shutdownTimeout) {
+			log.Println("warning: some jobs are still running")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("warning: requests still in progress after %v: %v", shutdownTimeout, err)
+		server.Close()
+	}
+
+	done := make(chan struct{})
+	jobFlushChannel <- done
+	<-done
+	audit.close()
+	log.Println("Server stopped")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleExit(t *testing.T) {
+	exit := func(body string) int {
+		w := httptest.NewRecorder()
+		handleExit(w, httptest.NewRequest(http.MethodPost, "/exit", strings.NewReader(body)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, exit(""))
+	assert.Equal(t, datamodel.JsonShutdownStruct{}, <-shutdownChannel)
+	assert.Equal(t, http.StatusOK, exit(`{"keepJobs": true}`))
+	assert.Equal(t, datamodel.JsonShutdownStruct{KeepJobs: true}, <-shutdownChannel)
+	assert.Equal(t, http.StatusOK, exit(`{"signal": "INT", "grace": 2}`))
+	assert.Equal(t, datamodel.JsonShutdownStruct{Signal: "INT", GraceInSecs: 2}, <-shutdownChannel)
+
+	assert.Equal(t, http.StatusBadRequest, exit(`{"signal": "NOPE"}`))
+	assert.Equal(t, http.StatusBadRequest, exit(`{"keepJobs": `))
+
+	// the server is already shutting down
+	assert.Equal(t, http.StatusOK, exit(""))
+	assert.Equal(t, http.StatusServiceUnavailable, exit(""))
+	<-shutdownChannel
+}
+
+func TestShutdownMiddleware(t *testing.T) {
+	defer func(c chan struct{}) { shuttingDown = c }(shuttingDown)
+	shuttingDown = make(chan struct{})
+
+	r := mux.NewRouter()
+	for _, route := range []string{"/jobs", "/runInBackground", "/upload"} {
+		r.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {})
+	}
+	r.Use(shutdownMiddleware)
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("/runInBackground"))
+	close(shuttingDown)
+	assert.Equal(t, http.StatusServiceUnavailable, status("/runInBackground"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/upload"))
+	assert.Equal(t, http.StatusOK, status("/jobs"))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"datamodel"
+)
+
+// stateFile is where the job table is saved, so that a restarted server can
+// re-adopt the jobs that are still running; if empty, it isn't saved
+var stateFile string
+
+// adoptedPollInterval is how often we check whether an adopted job (which
+// isn't our child, so can't be waited for) is still running
+const adoptedPollInterval = time.Second
+
+// savedState is the contents of the state file.
+type savedState struct {
+	NextJobNo datamodel.JobNoType       `json:"nextJobNo"`
+	Jobs      []savedJob                `json:"jobs"` // running jobs
+	History   []datamodel.JsonJobStruct `json:"history"`
+}
+
+// savedJob is a running (or pending) job, as saved in the state file.
+type savedJob struct {
+	datamodel.JsonJobStruct
+	StartTicks uint64                      `json:"startTicks"`
+	RequestID  string                      `json:"requestId,omitempty"`
+	Identity   string                      `json:"identity,omitempty"`
+	Deadline   time.Time                   `json:"deadline"`
+	TimedOut   bool                        `json:"timedOut,omitempty"`
+	Command    datamodel.JsonCommandStruct `json:"command"`
+}
+
+// processStartTicks returns the start time of a process, in clock ticks
+// since boot.
+func processStartTicks(pid int) (uint64, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the fields after the command name are: state ppid pgrp session tty_nr
+	// tpgid flags minflt cminflt majflt cmajflt utime stime cutime cstime
+	// priority nice num_threads itrealvalue starttime ...
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// processAlive reports whether the process started at startTicks is still
+// running (as opposed to gone, a zombie, or replaced by another process
+// with the same pid).
+func processAlive(pid int, startTicks uint64) bool {
+	ticks, err := processStartTicks(pid)
+	return err == nil && startTicks != 0 && ticks == startTicks && !isZombie(pid)
+}
+
+// saveState saves the job table to the state file (if there is one),
+// replacing it atomically.
+func saveState(nextJobNo datamodel.JobNoType, running map[*datamodel.ProcessJobStruct]any, history []*datamodel.ProcessJobStruct) {
+	if stateFile == "" {
+		return
+	}
+	state := savedState{
+		NextJobNo: nextJobNo,
+		Jobs:      make([]savedJob, 0, len(running)),
+		History:   make([]datamodel.JsonJobStruct, 0, len(history)),
+	}
+	for p := range running {
+		state.Jobs = append(state.Jobs, savedJob{
+			JsonJobStruct: p.JsonJobStruct,
+			StartTicks:    p.StartTicks,
+			RequestID:     p.RequestID,
+			Identity:      p.Identity,
+			Deadline:      p.Deadline,
+			TimedOut:      p.TimedOut,
+			Command:       p.Command,
+		})
+	}
+	for _, p := range history {
+		state.History = append(state.History, p.JsonJobStruct)
+	}
+	if err := writeFileAtomically(stateFile, state); err != nil {
+		log.Printf("warning: cannot save state to %s: %v", stateFile, err)
+	}
+}
+
+// writeFileAtomically writes v as JSON to a temporary file, and renames it to
+// path once it's safely on disk.
+func writeFileAtomically(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restoredJob makes a job loaded from the state file, whose output (if any)
+// is no longer available.
+func restoredJob(job datamodel.JsonJobStruct) *datamodel.ProcessJobStruct {
+	p := &datamodel.ProcessJobStruct{
+		Stdout:        datamodel.NewRingBuffer(0),
+		Stderr:        datamodel.NewRingBuffer(0),
+		Started:       make(chan struct{}),
+		Done:          make(chan struct{}),
+		JsonJobStruct: job,
+	}
+	p.Stdout.Close()
+	p.Stderr.Close()
+	switch job.State {
+	case datamodel.JobPending:
+	case datamodel.JobRunning, datamodel.JobRestarting:
+		close(p.Started)
+	case datamodel.JobCanceled, datamodel.JobFailed:
+		close(p.Done)
+	default:
+		close(p.Started)
+		close(p.Done)
+	}
+	return p
+}
+
+// restoredPendingJob makes a job loaded from the state file that has no
+// process (because it's pending, or waiting to be restarted), whose output can
+// be streamed once it starts.
+func restoredPendingJob(saved savedJob) *datamodel.ProcessJobStruct {
+	p := restoredJob(saved.JsonJobStruct)
+	p.Stdout = datamodel.NewRingBuffer(ringBufferSize)
+	p.Stderr = datamodel.NewRingBuffer(ringBufferSize)
+	p.RequestID = saved.RequestID
+	p.Identity = saved.Identity
+	p.Command = saved.Command
+	return p
+}
+
+// loadState loads the job table from the state file, if there is one.
+// Running jobs whose processes are still there are re-adopted; the others
+// are restarted if their restart policy says so, or else marked as orphaned
+// and moved to the history. Pending jobs are held again (see rescheduleJob),
+// and jobs that were waiting to be restarted are restarted. It returns the
+// running jobs, the history (oldest first) and the next job number.
+func loadState() (running, history []*datamodel.ProcessJobStruct, nextJobNo datamodel.JobNoType, err error) {
+	b, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, 0, nil
+	} else if err != nil {
+		return nil, nil, 0, err
+	}
+	var state savedState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, nil, 0, fmt.Errorf("%s: %v", stateFile, err)
+	}
+
+	for _, job := range state.History {
+		history = append(history, restoredJob(job))
+	}
+	for _, saved := range state.Jobs {
+		if saved.State == datamodel.JobPending || saved.State == datamodel.JobRestarting {
+			log.Printf("Job %v is still %v: %v", saved.JobNo, saved.State, saved.CmdLine)
+			running = append(running, restoredPendingJob(saved))
+			continue
+		}
+		p := restoredJob(saved.JsonJobStruct)
+		p.StartTicks = saved.StartTicks
+		p.RequestID = saved.RequestID
+		p.Identity = saved.Identity
+		p.Command = saved.Command
+		p.Deadline = saved.Deadline
+		p.TimedOut = saved.TimedOut
+		// (its output can be streamed again, once it's restarted, or if
+		// it's saved to files; see watchAdopted)
+		p.Stdout = datamodel.NewRingBuffer(ringBufferSize)
+		p.Stderr = datamodel.NewRingBuffer(ringBufferSize)
+		if processAlive(p.Pid, p.StartTicks) {
+			log.Printf("Re-adopted job %v (pid %v): %v", p.JobNo, p.Pid, p.CmdLine)
+			p.Adopted = true
+			running = append(running, p)
+			continue
+		}
+		if _, err := os.Stat(p.Cgroup); p.Cgroup != "" && err == nil {
+			p.Usage = cgroupUsage(p.Cgroup)
+			if len(cgroupMembers(p.Cgroup)) == 0 {
+				removeCgroup(p.Cgroup)
+			}
+		}
+		const failure = "exited while the server was down"
+		if _, ok := restartDelay(p, failure); ok {
+			log.Printf("Job %v (pid %v) is gone, restarting it: %v", p.JobNo, p.Pid, p.CmdLine)
+			now := time.Now()
+			p.State = datamodel.JobRestarting
+			p.LastFailure = failure
+			p.LastFailureAt = &now
+			running = append(running, p)
+			continue
+		}
+		log.Printf("Job %v (pid %v) is gone, marking it orphaned: %v", p.JobNo, p.Pid, p.CmdLine)
+		p.State = datamodel.JobOrphaned
+		p.Stdout.Close()
+		p.Stderr.Close()
+		close(p.Done)
+		history = append(history, p)
+	}
+	if len(history) > maxJobHistory {
+		history = history[len(history)-maxJobHistory:]
+	}
+	return running, history, state.NextJobNo, nil
+}
+
+// watchAdopted waits for an adopted job's process to go away (checking every
+// adoptedPollInterval), and then reports its exit to the jobManager. It also
+// enforces the job's timeout, if it has one, and follows its output files
+// meanwhile (see followAdoptedOutput).
+func watchAdopted(p *datamodel.ProcessJobStruct) {
+	if !p.Deadline.IsZero() && !p.TimedOut {
+		time.AfterFunc(time.Until(p.Deadline), func() {
+			jobTimeoutChannel <- p.JobNo
+		})
+	}
+	stop := followAdoptedOutput(p)
+	for processAlive(p.Pid, p.StartTicks) {
+		time.Sleep(adoptedPollInterval)
+	}
+	stop()
+	jobExitChannel <- p
+}
+
+// followAdoptedOutput copies what an adopted job writes to its output files
+// (if it has any) to its ring buffers, starting with as much of what's already
+// there as they can hold (see followOutput). It returns a function that stops
+// following the files.
+func followAdoptedOutput(p *datamodel.ProcessJobStruct) func() {
+	var stops []func()
+	for _, out := range []struct {
+		fileName string
+		rb       *datamodel.RingBuffer
+	}{{p.StdoutFile, p.Stdout}, {p.StderrFile, p.Stderr}} {
+		if out.fileName == "" {
+			continue
+		}
+		offset := int64(0)
+		if fi, err := os.Stat(out.fileName); err == nil && fi.Size() > int64(ringBufferSize) {
+			offset = fi.Size() - int64(ringBufferSize)
+		}
+		stop, err := followOutput(out.fileName, offset, out.rb)
+		if err != nil {
+			log.Printf("warning: cannot follow the output of job %v: %v", p.JobNo, err)
+			continue
+		}
+		stops = append(stops, stop)
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessAlive(t *testing.T) {
+	ticks, err := processStartTicks(os.Getpid())
+	assert.NoError(t, err)
+	assert.NotZero(t, ticks)
+	assert.True(t, processAlive(os.Getpid(), ticks))
+	assert.False(t, processAlive(os.Getpid(), ticks+1), "a different process with the same pid")
+	assert.False(t, processAlive(os.Getpid(), 0))
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	defer func(file string, history int) { stateFile, maxJobHistory = file, history }(stateFile, maxJobHistory)
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	maxJobHistory = 2
+
+	// a job that's still running, and one whose process has gone
+	sleep := exec.Command("sleep", "30")
+	assert.NoError(t, sleep.Start())
+	defer sleep.Process.Kill()
+	sleepTicks, err := processStartTicks(sleep.Process.Pid)
+	assert.NoError(t, err)
+	startAt := time.Now().Add(time.Hour).Round(0)
+	gone := exec.Command("true")
+	assert.NoError(t, gone.Run())
+
+	running := map[*datamodel.ProcessJobStruct]any{
+		{StartTicks: sleepTicks, RequestID: "abc", JsonJobStruct: datamodel.JsonJobStruct{JobNo: 3, Pid: sleep.Process.Pid, CmdLine: "sleep 30", State: datamodel.JobRunning}}: nil,
+		{StartTicks: sleepTicks, JsonJobStruct: datamodel.JsonJobStruct{JobNo: 4, Pid: gone.Process.Pid, CmdLine: "true", State: datamodel.JobRunning}}:                        nil,
+		{Command: datamodel.JsonCommandStruct{Cmd: "echo", StartAt: &startAt}, JsonJobStruct: datamodel.JsonJobStruct{JobNo: 5, CmdLine: "echo", State: datamodel.JobPending}}: nil,
+		// gone, but to be restarted
+		{StartTicks: sleepTicks, Command: datamodel.JsonCommandStruct{Cmd: "true", Restart: datamodel.RestartOnFailure}, JsonJobStruct: datamodel.JsonJobStruct{JobNo: 6, Pid: gone.Process.Pid, CmdLine: "true", State: datamodel.JobRunning}}: nil,
+	}
+	history := []*datamodel.ProcessJobStruct{
+		{JsonJobStruct: datamodel.JsonJobStruct{JobNo: 1, State: datamodel.JobExited}},
+		{JsonJobStruct: datamodel.JsonJobStruct{JobNo: 2, State: datamodel.JobExited}},
+	}
+	saveState(7, running, history)
+
+	adopted, restoredHistory, nextJobNo, err := loadState()
+	assert.NoError(t, err)
+	assert.Equal(t, datamodel.JobNoType(7), nextJobNo)
+	sort.Slice(adopted, func(i, j int) bool { return adopted[i].JobNo < adopted[j].JobNo })
+	if assert.Len(t, adopted, 3) {
+		p := adopted[0]
+		assert.Equal(t, datamodel.JobNoType(3), p.JobNo)
+		assert.True(t, p.Adopted)
+		assert.Equal(t, datamodel.JobRunning, p.State)
+		assert.Equal(t, "abc", p.RequestID)
+		assert.Nil(t, p.Cmd)
+		// (its output is followed until it exits; see watchAdopted)
+		_, _, closed, _ := p.Stdout.Snapshot(0)
+		assert.False(t, closed)
+
+		// a pending job is held again, and its output can still be streamed
+		p = adopted[1]
+		assert.Equal(t, datamodel.JobNoType(5), p.JobNo)
+		assert.Equal(t, datamodel.JobPending, p.State)
+		assert.Equal(t, "echo", p.Command.Cmd)
+		assert.True(t, startAt.Equal(*p.Command.StartAt))
+		_, _, closed, _ = p.Stdout.Snapshot(0)
+		assert.False(t, closed)
+
+		p = adopted[2]
+		assert.Equal(t, datamodel.JobNoType(6), p.JobNo)
+		assert.Equal(t, datamodel.JobRestarting, p.State)
+		assert.Equal(t, "exited while the server was down", p.LastFailure)
+	}
+	// the oldest finished job no longer fits in the history
+	if assert.Len(t, restoredHistory, 2) {
+		assert.Equal(t, datamodel.JobNoType(2), restoredHistory[0].JobNo)
+		assert.Equal(t, datamodel.JobNoType(4), restoredHistory[1].JobNo)
+		assert.Equal(t, datamodel.JobOrphaned, restoredHistory[1].State)
+	}
+
+	// no state file yet
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	adopted, restoredHistory, nextJobNo, err = loadState()
+	assert.NoError(t, err)
+	assert.Empty(t, adopted)
+	assert.Empty(t, restoredHistory)
+	assert.Zero(t, nextJobNo)
+}
+
+func TestFollowAdoptedOutput(t *testing.T) {
+	defer func(size int) { ringBufferSize = size }(ringBufferSize)
+	ringBufferSize = 8
+	fileName := filepath.Join(t.TempDir(), "out")
+	assert.NoError(t, os.WriteFile(fileName, []byte("written while the server was down\n"), 0666))
+
+	// the ring buffer starts with the end of what's already in the file, and
+	// then follows it
+	p := &datamodel.ProcessJobStruct{
+		Stdout:        datamodel.NewRingBuffer(ringBufferSize),
+		Stderr:        datamodel.NewRingBuffer(ringBufferSize),
+		JsonJobStruct: datamodel.JsonJobStruct{JobNo: 1, StdoutFile: fileName},
+	}
+	stop := followAdoptedOutput(p)
+	assert.Eventually(t, func() bool {
+		data, _, _, _ := p.Stdout.Snapshot(0)
+		return string(data) == "as down\n"
+	}, time.Second, 10*time.Millisecond)
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	f.Write([]byte("more\n"))
+	f.Close()
+	stop()
+	data, _, _, _ := p.Stdout.Snapshot(0)
+	assert.Equal(t, "wn\nmore\n", string(data))
+}
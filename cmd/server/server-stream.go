@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+)
+
+// stopStreaming is closed when the server stops serving requests, so that
+// streams that are following a job's output end
+var stopStreaming = make(chan struct{})
+
+// handleStreamJob handles the "/jobs/{id}/stream" endpoint and streams the
+// recent output of a job from its in-memory ring buffer. Query parameters:
+//
+//	fd      "stdout" (the default) or "stderr"
+//	follow  if true, keep streaming new output until the job exits
+//	offset  absolute offset in the output to start from (default 0)
+//	format  "raw" for a plain chunked response, or "sse" for Server-Sent
+//	        Events; defaults to "sse" if the client accepts text/event-stream
+//
+// Raw responses report the offset of their first byte in the X-Stream-Offset
+// header. SSE responses send one event per line of output, with the event id
+// set to the offset just past that line, so that a reconnecting client's
+// Last-Event-ID resumes where it left off.
+func handleStreamJob(w http.ResponseWriter, r *http.Request) {
+	jobNo, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+
+	jobLookupChannel <- datamodel.JobNoType(jobNo)
+	job := <-jobLookupResponseChannel
+	if job == nil {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+
+	var rb *datamodel.RingBuffer
+	switch query.Get("fd") {
+	case "", "stdout":
+		rb = job.Stdout
+	case "stderr":
+		rb = job.Stderr
+	default:
+		http.Error(w, "fd must be stdout or stderr", http.StatusBadRequest)
+		return
+	}
+
+	follow := false
+	if s := query.Get("follow"); s != "" {
+		if follow, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "invalid follow: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	offsetString := query.Get("offset")
+	if offsetString == "" {
+		offsetString = r.Header.Get("Last-Event-ID")
+	}
+	offset := int64(0)
+	if offsetString != "" {
+		if offset, err = strconv.ParseInt(offsetString, 10, 64); err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var sse bool
+	switch query.Get("format") {
+	case "":
+		sse = strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	case "raw":
+	case "sse":
+		sse = true
+	default:
+		http.Error(w, "format must be raw or sse", http.StatusBadRequest)
+		return
+	}
+
+	data, start, closed, changed := rb.Snapshot(offset)
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("X-Stream-Offset", strconv.FormatInt(start, 10))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	// in SSE mode, a partial line is held back until the rest of it arrives
+	var partial []byte
+	next := start
+	for {
+		next = start + int64(len(data))
+		if sse {
+			partial = writeEvents(w, append(partial, data...), next)
+		} else {
+			w.Write(data)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if closed || !follow {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-stopStreaming:
+			// send whatever is left, and stop
+			follow = false
+		case <-r.Context().Done():
+			return
+		}
+		data, start, closed, changed = rb.Snapshot(next)
+		if start > next {
+			// we fell behind and some output was overwritten
+			partial = nil
+		}
+	}
+
+	if sse {
+		if len(partial) > 0 {
+			writeEvent(w, partial, next)
+		}
+		if closed {
+			fmt.Fprintf(w, "event: eof\nid: %d\ndata:\n\n", next)
+		}
+	}
+}
+
+// writeEvents writes each complete line in buf as a Server-Sent Event. end is
+// the stream offset just past the end of buf. Any trailing partial line is
+// returned.
+func writeEvents(w io.Writer, buf []byte, end int64) []byte {
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return buf
+		}
+		line := buf[:i]
+		buf = buf[i+1:]
+		writeEvent(w, line, end-int64(len(buf)))
+	}
+}
+
+// writeEvent writes a single line of output as a Server-Sent Event whose id
+// is the given offset.
+func writeEvent(w io.Writer, line []byte, id int64) {
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, bytes.TrimSuffix(line, []byte("\r")))
+}
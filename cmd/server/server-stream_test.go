@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// streamJob requests the output of job p (or of a job that doesn't exist, if p
+// is nil) from handleStreamJob, answering its lookup in place of the
+// jobManager.
+func streamJob(p *datamodel.ProcessJobStruct, query string, header http.Header) *httptest.ResponseRecorder {
+	go func() {
+		<-jobLookupChannel
+		jobLookupResponseChannel <- p
+	}()
+	r := httptest.NewRequest(http.MethodGet, "/jobs/1/stream?"+query, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	handleStreamJob(w, mux.SetURLVars(r, map[string]string{"id": "1"}))
+	return w
+}
+
+func TestHandleStreamJob(t *testing.T) {
+	p := &datamodel.ProcessJobStruct{
+		Stdout:        datamodel.NewRingBuffer(64),
+		Stderr:        datamodel.NewRingBuffer(64),
+		JsonJobStruct: datamodel.JsonJobStruct{JobNo: 1},
+	}
+	p.Stdout.Write([]byte("one\ntwo\nthr"))
+	p.Stderr.Write([]byte("oops\n"))
+
+	w := streamJob(p, "format=raw", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("X-Stream-Offset"))
+	assert.Equal(t, "one\ntwo\nthr", w.Body.String())
+	w = streamJob(p, "format=raw&fd=stderr&offset=2", nil)
+	assert.Equal(t, "2", w.Header().Get("X-Stream-Offset"))
+	assert.Equal(t, "ps\n", w.Body.String())
+	w = streamJob(p, "format=raw&offset=100", nil)
+	assert.Equal(t, "11", w.Header().Get("X-Stream-Offset"))
+	assert.Empty(t, w.Body.String())
+
+	// each event's id is the offset just past its line, and the partial line
+	// at the end is sent as it is, since we aren't following the job
+	w = streamJob(p, "", http.Header{"Accept": {"text/event-stream"}})
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "id: 4\ndata: one\n\nid: 8\ndata: two\n\nid: 11\ndata: thr\n\n", w.Body.String())
+
+	// a reconnecting client resumes after the last event it got
+	w = streamJob(p, "format=sse", http.Header{"Last-Event-Id": {"4"}})
+	assert.Equal(t, "4", w.Header().Get("X-Stream-Offset"))
+	assert.Equal(t, "id: 8\ndata: two\n\nid: 11\ndata: thr\n\n", w.Body.String())
+
+	// when following, the partial line is held back until the rest of it
+	// arrives, and the stream ends once the job has finished
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Stdout.Write([]byte("ee\nfour\n"))
+		p.Stdout.Close()
+	}()
+	w = streamJob(p, "format=sse&follow=true&offset=8", nil)
+	assert.Equal(t, "id: 14\ndata: three\n\nid: 19\ndata: four\n\nevent: eof\nid: 19\ndata:\n\n", w.Body.String())
+	w = streamJob(p, "format=sse&offset=19", nil)
+	assert.Equal(t, "event: eof\nid: 19\ndata:\n\n", w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, streamJob(nil, "", nil).Code)
+	for _, query := range []string{"fd=stdin", "follow=maybe", "offset=-1", "format=xml"} {
+		assert.Equal(t, http.StatusBadRequest, streamJob(p, query, nil).Code, query)
+	}
+}
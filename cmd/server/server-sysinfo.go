@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"datamodel"
+)
+
+// clockTicks is the number of clock ticks per second used by /proc/stat
+// (USER_HZ, which is 100 on every Linux architecture that we care about)
+const clockTicks = 100
+
+// maxSysInfoSample is the longest CPU sampling interval that /sysinfo allows
+const maxSysInfoSample = 10 * time.Second
+
+// tcpListen is the state of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+// parseLoadAvg parses /proc/loadavg.
+func parseLoadAvg(s string) ([3]float64, error) {
+	var load [3]float64
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return load, errors.New("malformed loadavg")
+	}
+	for i := range load {
+		var err error
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return load, err
+		}
+	}
+	return load, nil
+}
+
+// parseUptime parses /proc/uptime.
+func parseUptime(s string) (float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 1 {
+		return 0, errors.New("malformed uptime")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// parseCPUStat parses the aggregate "cpu" line of /proc/stat.
+func parseCPUStat(r io.Reader) (datamodel.JsonCPUStruct, error) {
+	var cpu datamodel.JsonCPUStruct
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] != "cpu" {
+			continue
+		}
+		// user nice system idle iowait irq softirq steal ...
+		var ticks [7]float64
+		for i := range ticks {
+			n, err := strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return cpu, err
+			}
+			ticks[i] = float64(n) / clockTicks
+		}
+		cpu.UserSecs = ticks[0] + ticks[1]
+		cpu.SystemSecs = ticks[2]
+		cpu.IdleSecs = ticks[3]
+		cpu.IOWaitSecs = ticks[4]
+		cpu.OtherSecs = ticks[5] + ticks[6]
+		if len(fields) > 8 {
+			if steal, err := strconv.ParseUint(fields[8], 10, 64); err == nil {
+				cpu.OtherSecs += float64(steal) / clockTicks
+			}
+		}
+		return cpu, nil
+	}
+	return cpu, errors.New("no cpu line in /proc/stat")
+}
+
+// busyPercent returns the percentage of CPU time between two samples that
+// wasn't idle or waiting for I/O.
+func busyPercent(before, after datamodel.JsonCPUStruct) float64 {
+	busy := (after.UserSecs + after.SystemSecs + after.OtherSecs) - (before.UserSecs + before.SystemSecs + before.OtherSecs)
+	idle := (after.IdleSecs + after.IOWaitSecs) - (before.IdleSecs + before.IOWaitSecs)
+	if busy+idle <= 0 {
+		return 0
+	}
+	return 100 * busy / (busy + idle)
+}
+
+// parseMemInfo parses /proc/meminfo.
+func parseMemInfo(r io.Reader) (datamodel.JsonMemoryStruct, error) {
+	var mem datamodel.JsonMemoryStruct
+	fields := map[string]*int64{
+		"MemTotal":     &mem.TotalBytes,
+		"MemAvailable": &mem.AvailableBytes,
+		"MemFree":      &mem.FreeBytes,
+		"SwapTotal":    &mem.SwapTotalBytes,
+		"SwapFree":     &mem.SwapFreeBytes,
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// e.g. "MemTotal:        6147400 kB"
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		field, wanted := fields[name]
+		if !ok || !wanted {
+			continue
+		}
+		parts := strings.Fields(value)
+		if len(parts) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return mem, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(parts) > 1 && parts[1] == "kB" {
+			n *= 1024
+		}
+		*field = n
+	}
+	return mem, scanner.Err()
+}
+
+// parseNetDev parses /proc/net/dev.
+func parseNetDev(r io.Reader) ([]datamodel.JsonInterfaceStruct, error) {
+	interfaces := make([]datamodel.JsonInterfaceStruct, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// the first two lines are headers, which have no colon after the
+		// interface name
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			continue
+		}
+		var n [16]uint64
+		for i := range n {
+			var err error
+			if n[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: %v", strings.TrimSpace(name), err)
+			}
+		}
+		// receive: bytes packets errs drop fifo frame compressed multicast,
+		// then transmit: bytes packets errs drop ...
+		interfaces = append(interfaces, datamodel.JsonInterfaceStruct{
+			Name:      strings.TrimSpace(name),
+			RxBytes:   n[0],
+			RxPackets: n[1],
+			RxErrors:  n[2],
+			RxDropped: n[3],
+			TxBytes:   n[8],
+			TxPackets: n[9],
+			TxErrors:  n[10],
+			TxDropped: n[11],
+		})
+	}
+	return interfaces, scanner.Err()
+}
+
+// parseProcNetAddress parses an address from /proc/net/tcp{,6}, such as
+// "0100007F:1F90". The address is hex in the host's (little-endian) byte
+// order, 32 bits at a time; the port is hex.
+func parseProcNetAddress(s string) (string, int, error) {
+	addr, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed address %q", s)
+	}
+	b, err := hex.DecodeString(addr)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return "", 0, fmt.Errorf("malformed address %q", s)
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(b[i:]))
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed port in %q", s)
+	}
+	return ip.String(), int(p), nil
+}
+
+// parseListeningTCP returns the listening sockets in /proc/net/tcp (or
+// tcp6, for which proto should be "tcp6").
+func parseListeningTCP(r io.Reader, proto string) ([]datamodel.JsonSocketStruct, error) {
+	sockets := make([]datamodel.JsonSocketStruct, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] == "sl" || fields[3] != tcpListen {
+			continue
+		}
+		address, port, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.Atoi(fields[7])
+		sockets = append(sockets, datamodel.JsonSocketStruct{Proto: proto, Address: address, Port: port, UID: uid})
+	}
+	return sockets, scanner.Err()
+}
+
+// readProcFile reads a file in /proc and parses it with parse.
+func readProcFile[T any](path string, parse func(io.Reader) (T, error)) (T, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+// diskInfo describes the filesystem holding path.
+func diskInfo(path string) (datamodel.JsonDiskStruct, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return datamodel.JsonDiskStruct{}, err
+	}
+	return datamodel.JsonDiskStruct{
+		Path:           path,
+		TotalBytes:     int64(fs.Blocks) * fs.Bsize,
+		FreeBytes:      int64(fs.Bfree) * fs.Bsize,
+		AvailableBytes: int64(fs.Bavail) * fs.Bsize,
+	}, nil
+}
+
+// getSysInfo describes the host. The disk usage is that of the filesystem
+// holding diskPath.
+func getSysInfo(diskPath string) (datamodel.JsonSysInfoStruct, error) {
+	info := datamodel.JsonSysInfoStruct{NumCPU: runtime.NumCPU()}
+	var err error
+
+	if info.Hostname, err = os.Hostname(); err != nil {
+		return info, err
+	}
+	b, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return info, err
+	}
+	info.KernelVersion = strings.TrimSpace(string(b))
+	if b, err = os.ReadFile("/proc/uptime"); err != nil {
+		return info, err
+	}
+	if info.UptimeSecs, err = parseUptime(string(b)); err != nil {
+		return info, err
+	}
+	if b, err = os.ReadFile("/proc/loadavg"); err != nil {
+		return info, err
+	}
+	if info.LoadAvg, err = parseLoadAvg(string(b)); err != nil {
+		return info, err
+	}
+	if info.CPU, err = readProcFile("/proc/stat", parseCPUStat); err != nil {
+		return info, err
+	}
+	if info.Memory, err = readProcFile("/proc/meminfo", parseMemInfo); err != nil {
+		return info, err
+	}
+	if info.Disk, err = diskInfo(diskPath); err != nil {
+		return info, err
+	}
+	if info.Interfaces, err = readProcFile("/proc/net/dev", parseNetDev); err != nil {
+		return info, err
+	}
+	info.Listening = make([]datamodel.JsonSocketStruct, 0)
+	for _, proto := range []string{"tcp", "tcp6"} {
+		sockets, err := readProcFile("/proc/net/"+proto, func(r io.Reader) ([]datamodel.JsonSocketStruct, error) {
+			return parseListeningTCP(r, proto)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			// (tcp6 is missing if IPv6 is disabled)
+			return info, err
+		}
+		info.Listening = append(info.Listening, sockets...)
+	}
+	return info, nil
+}
+
+// handleSysInfo handles the "/sysinfo" endpoint and describes the host. The
+// optional "workspace" query parameter selects the workspace whose disk
+// usage is reported (by default, that of the workspace root), and the
+// optional "sample" parameter (e.g. "1s") measures how busy the CPUs are
+// over that interval.
+func handleSysInfo(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	diskPath := workspaceRoot
+	if workspace := query.Get("workspace"); workspace != "" {
+		var err error
+		if diskPath, err = workspaceDir(workspace); err != nil {
+			writeSetupError(w, err)
+			return
+		}
+	}
+
+	var sample time.Duration
+	var before datamodel.JsonCPUStruct
+	if s := query.Get("sample"); s != "" {
+		var err error
+		if sample, err = time.ParseDuration(s); err != nil || sample <= 0 || sample > maxSysInfoSample {
+			http.Error(w, fmt.Sprintf("sample must be a duration of at most %v", maxSysInfoSample), http.StatusBadRequest)
+			return
+		}
+		if before, err = readProcFile("/proc/stat", parseCPUStat); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-time.After(sample):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	info, err := getSysInfo(diskPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sample > 0 {
+		busy := busyPercent(before, info.CPU)
+		info.CPU.BusyPercent = &busy
+	}
+	writeJson(info, w)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLoadAvgAndUptime(t *testing.T) {
+	load, err := parseLoadAvg("0.52 0.58 0.59 2/345 12345\n")
+	assert.NoError(t, err)
+	assert.Equal(t, [3]float64{0.52, 0.58, 0.59}, load)
+	_, err = parseLoadAvg("0.52\n")
+	assert.Error(t, err)
+
+	uptime, err := parseUptime("3600.25 7000.50\n")
+	assert.NoError(t, err)
+	assert.Equal(t, 3600.25, uptime)
+}
+
+func TestParseCPUStat(t *testing.T) {
+	stat := `cpu  1000 200 300 5000 100 50 25 25 0 0
+cpu0 500 100 150 2500 50 5 10 15 0 0
+intr 12345
+`
+	cpu, err := parseCPUStat(strings.NewReader(stat))
+	assert.NoError(t, err)
+	assert.Equal(t, datamodel.JsonCPUStruct{UserSecs: 12, SystemSecs: 3, IdleSecs: 50, IOWaitSecs: 1, OtherSecs: 1}, cpu)
+
+	later := cpu
+	later.UserSecs += 3
+	later.IdleSecs += 1
+	assert.InDelta(t, 75.0, busyPercent(cpu, later), 1e-9)
+
+	_, err = parseCPUStat(strings.NewReader("intr 12345\n"))
+	assert.Error(t, err)
+}
+
+func TestParseMemInfo(t *testing.T) {
+	meminfo := `MemTotal:        6147400 kB
+MemFree:         1024000 kB
+MemAvailable:    4096000 kB
+Buffers:          102400 kB
+SwapTotal:       2097148 kB
+SwapFree:        2097148 kB
+HugePages_Total:       0
+`
+	mem, err := parseMemInfo(strings.NewReader(meminfo))
+	assert.NoError(t, err)
+	assert.Equal(t, datamodel.JsonMemoryStruct{
+		TotalBytes:     6147400 * 1024,
+		AvailableBytes: 4096000 * 1024,
+		FreeBytes:      1024000 * 1024,
+		SwapTotalBytes: 2097148 * 1024,
+		SwapFreeBytes:  2097148 * 1024,
+	}, mem)
+}
+
+func TestParseNetDev(t *testing.T) {
+	netdev := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:   12345     100    0    0    0     0          0         0    12345     100    0    0    0     0       0          0
+  eth0: 9876543    5000    1    2    0     0          0        10  1234567    4000    3    4    0     0       0          0
+`
+	interfaces, err := parseNetDev(strings.NewReader(netdev))
+	assert.NoError(t, err)
+	assert.Equal(t, []datamodel.JsonInterfaceStruct{
+		{Name: "lo", RxBytes: 12345, RxPackets: 100, TxBytes: 12345, TxPackets: 100},
+		{Name: "eth0", RxBytes: 9876543, RxPackets: 5000, RxErrors: 1, RxDropped: 2, TxBytes: 1234567, TxPackets: 4000, TxErrors: 3, TxDropped: 4},
+	}, interfaces)
+}
+
+func TestParseListeningTCP(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 00000000:20FB 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1002 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D2F0 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+`
+	sockets, err := parseListeningTCP(strings.NewReader(tcp), "tcp")
+	assert.NoError(t, err)
+	assert.Equal(t, []datamodel.JsonSocketStruct{
+		{Proto: "tcp", Address: "127.0.0.1", Port: 8080},
+		{Proto: "tcp", Address: "0.0.0.0", Port: 8443, UID: 1000},
+	}, sockets)
+
+	tcp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2001 1 0000000000000000 100 0 0 10 0
+   1: 000080FE00000000FF005452F5A3C2FE:01BB 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2002 1 0000000000000000 100 0 0 10 0
+`
+	sockets, err = parseListeningTCP(strings.NewReader(tcp6), "tcp6")
+	assert.NoError(t, err)
+	assert.Equal(t, []datamodel.JsonSocketStruct{
+		{Proto: "tcp6", Address: "::1", Port: 22},
+		{Proto: "tcp6", Address: "fe80::5254:ff:fec2:a3f5", Port: 443},
+	}, sockets)
+
+	_, _, err = parseProcNetAddress("0100007F")
+	assert.Error(t, err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+)
+
+// workspaceRoot is the directory in which workspaces are created
+var workspaceRoot = "workspaces"
+
+// validWorkspaceName matches the names that workspaces may have
+var validWorkspaceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// defaultWorkspace is the workspace used by requests that don't name one
+const defaultWorkspace = "default"
+
+// errNoSuchWorkspace is returned when a request names a workspace that
+// doesn't exist
+var errNoSuchWorkspace = errors.New("no such workspace")
+
+// initWorkspaces creates the workspace root and the default workspace, if
+// necessary, and makes the root's path absolute.
+func initWorkspaces() error {
+	root, err := filepath.Abs(workspaceRoot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(root, defaultWorkspace), 0755); err != nil {
+		return err
+	}
+	workspaceRoot = root
+	return nil
+}
+
+// workspaceDir returns the directory of the named workspace, which must
+// exist. The empty name refers to the default workspace, which is created
+// again if it has been deleted.
+func workspaceDir(name string) (string, error) {
+	if name == "" {
+		dir := filepath.Join(workspaceRoot, defaultWorkspace)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+	if !validWorkspaceName.MatchString(name) {
+		return "", fmt.Errorf("invalid workspace name %q", name)
+	}
+	dir := filepath.Join(workspaceRoot, name)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return "", errNoSuchWorkspace
+	}
+	return dir, nil
+}
+
+// isWithin reports whether path is root or is inside it. Both must be clean
+// and absolute.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveInWorkspace resolves p relative to dir (which must be inside the
+// workspace root), and makes sure that the result is also inside root, even
+// after following any symbolic links in the part of the path that already
+// exists. Absolute paths are not allowed.
+func resolveInWorkspace(root, dir, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return "", fmt.Errorf("%q: absolute paths are not allowed", p)
+	}
+	path := filepath.Join(dir, p)
+	if !isWithin(root, path) {
+		return "", fmt.Errorf("%q: path escapes the workspace", p)
+	}
+
+	// find the longest prefix of the path that exists, and make sure that it
+	// doesn't lead outside of the workspace via a symbolic link
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	realExisting, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(realRoot, realExisting) {
+		return "", fmt.Errorf("%q: path escapes the workspace", p)
+	}
+	return path, nil
+}
+
+// workspaceInfo describes the workspace with the given name.
+func workspaceInfo(name string) (datamodel.JsonWorkspaceStruct, error) {
+	dir := filepath.Join(workspaceRoot, name)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return datamodel.JsonWorkspaceStruct{}, err
+	}
+	return datamodel.JsonWorkspaceStruct{
+		Name:    name,
+		Path:    dir,
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// workspaceInUse reports whether any running job was started in the named
+// workspace.
+func workspaceInUse(name string) bool {
+	jobListRequestChannel <- filterRunning
+	for _, job := range <-jobListResponseChannel {
+		// (jobs saved by older servers may have no workspace, meaning the
+		// default one)
+		if job.Workspace == name || (job.Workspace == "" && name == defaultWorkspace) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleListWorkspaces handles the "/workspaces" endpoint and lists the
+// workspaces.
+func handleListWorkspaces(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(workspaceRoot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	workspaces := make([]datamodel.JsonWorkspaceStruct, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || !validWorkspaceName.MatchString(entry.Name()) {
+			continue
+		}
+		if info, err := workspaceInfo(entry.Name()); err == nil {
+			workspaces = append(workspaces, info)
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool { return workspaces[i].Name < workspaces[j].Name })
+	writeJson(workspaces, w)
+}
+
+// handleWorkspace handles the "/workspaces/{name}" endpoint. GET describes the
+// workspace, PUT or POST creates it (if it doesn't already exist), and DELETE
+// removes it along with its contents.
+func handleWorkspace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validWorkspaceName.MatchString(name) {
+		http.Error(w, "invalid workspace name", http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(workspaceRoot, name)
+
+	switch r.Method {
+	case http.MethodGet:
+		info, err := workspaceInfo(name)
+		if err != nil {
+			http.Error(w, errNoSuchWorkspace.Error(), http.StatusNotFound)
+			return
+		}
+		writeJson(info, w)
+
+	case http.MethodPut, http.MethodPost:
+		if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info, err := workspaceInfo(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(info, w)
+
+	case http.MethodDelete:
+		if _, err := os.Stat(dir); err != nil {
+			http.Error(w, errNoSuchWorkspace.Error(), http.StatusNotFound)
+			return
+		}
+		if workspaceInUse(name) {
+			http.Error(w, "workspace has running jobs", http.StatusConflict)
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(true, w)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
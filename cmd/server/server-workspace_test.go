@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveInWorkspace(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "iter1"), 0755))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+
+	for _, p := range []string{"", "foo.log", "iter1/foo.log", "new/dir/foo.log", "iter1/../foo.log"} {
+		path, err := resolveInWorkspace(root, root, p)
+		assert.NoError(t, err, p)
+		assert.Equal(t, filepath.Join(root, p), path, p)
+	}
+
+	// relative to a subdirectory of the workspace
+	path, err := resolveInWorkspace(root, filepath.Join(root, "iter1"), "../foo.log")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "foo.log"), path)
+
+	for _, p := range []string{"..", "../foo.log", "iter1/../../foo.log", "/etc/passwd", "escape/foo.log", "escape"} {
+		_, err := resolveInWorkspace(root, root, p)
+		assert.Error(t, err, p)
+	}
+}
+
+func TestWorkspaceDir(t *testing.T) {
+	oldRoot := workspaceRoot
+	defer func() { workspaceRoot = oldRoot }()
+	workspaceRoot = t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(workspaceRoot, "exp1"), 0755))
+
+	dir, err := workspaceDir("exp1")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(workspaceRoot, "exp1"), dir)
+
+	_, err = workspaceDir("exp2")
+	assert.ErrorIs(t, err, errNoSuchWorkspace)
+
+	for _, name := range []string{"..", ".hidden", "a/b", "a b"} {
+		_, err := workspaceDir(name)
+		assert.Error(t, err, name)
+	}
+
+	// the empty name is the default workspace, which is created if necessary
+	dir, err = workspaceDir("")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(workspaceRoot, defaultWorkspace), dir)
+	assert.DirExists(t, dir)
+}
+
+func TestDeleteWorkspaceInUse(t *testing.T) {
+	runJobManager(t)
+	deleteWorkspace := func(name string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/workspaces/"+name, nil)
+		w := httptest.NewRecorder()
+		handleWorkspace(w, mux.SetURLVars(r, map[string]string{"name": name}))
+		return w.Code
+	}
+	require.NoError(t, initWorkspaces())
+
+	// a job that names no workspace runs in the default one, which can't be
+	// deleted from under it
+	job := runInBackground(t, `{"cmd":"sleep","args":["30"]}`)
+	assert.Equal(t, defaultWorkspace, job.Workspace)
+	assert.Equal(t, filepath.Join(workspaceRoot, defaultWorkspace), job.Cwd)
+	assert.Equal(t, http.StatusConflict, deleteWorkspace(defaultWorkspace))
+	assert.DirExists(t, job.Cwd)
+	assert.Equal(t, http.StatusOK, deleteWorkspace("exp1"))
+
+	killJobs(func(p *datamodel.ProcessJobStruct) bool { return p.JobNo == job.JobNo }, syscall.SIGKILL, defaultKillGrace)
+	waitForJob(t, job.JobNo, 5*time.Second)
+	assert.Equal(t, http.StatusOK, deleteWorkspace(defaultWorkspace))
+	assert.NoDirExists(t, job.Cwd)
+}
@@ -7,24 +7,29 @@ Micah Sherr <msherr@cs.georgetown.edu>
 Provides a server implementation for running and managing background processes.
 The server exposes several HTTP endpoints for executing commands, managing jobs,
 and retrieving job information. It also includes an authentication middleware
-for validating requests using a session token.
+for validating requests using session tokens, HMAC signatures or client
+certificates.
 
 WARNING: This program is extremely dangerous and you probably don't want to run
-it on any machine you care about.  It allows arbitrary command execution, and is
-intended for managing experiments.
+it on any machine you care about.  It allows arbitrary command execution (unless
+restricted by a policy file; see -policy), and is intended for managing
+experiments.
 */
 package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"datamodel"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
-	"strconv"
+	"sort"
 	"syscall"
 	"time"
 
@@ -35,34 +40,60 @@ import (
 const version = "0.0.1"
 
 // jobList represents a list of jobs.
-type jobList []struct {
-	JobNo      datamodel.JobNoType `json:"jobNo"`
-	CmdLine    string              `json:"cmdLine"`
-	StdoutFile string              `json:"stdoutFile"`
-	StderrFile string              `json:"stderrFile"`
-}
+type jobList []datamodel.JsonJobStruct
 
 // Variables
 
 var processChannel = make(chan *datamodel.ProcessJobStruct)
 var jobChannel = make(chan datamodel.JobNoType)
+var jobExitChannel = make(chan *datamodel.ProcessJobStruct)
 
 // Channels for job list management
-var jobListRequestChannel = make(chan any)
+var jobListRequestChannel = make(chan jobStateFilter)
 var jobListResponseChannel = make(chan jobList)
-var jobKillChannel = make(chan datamodel.JobNoType)
+var jobKillChannel = make(chan func(*datamodel.ProcessJobStruct) bool)
+var jobTimeoutChannel = make(chan datamodel.JobNoType)
+var jobKillResponseChannel = make(chan jobsToKill)
+var jobLookupChannel = make(chan datamodel.JobNoType)
+var jobLookupResponseChannel = make(chan *datamodel.ProcessJobStruct)
+
+// jobManagerStopChannel stops the jobManager. (Only tests stop it; the server
+// runs it for as long as it runs.)
+var jobManagerStopChannel = make(chan struct{})
+
+// maxJobHistory is the number of finished jobs that are remembered
+var maxJobHistory = 1000
+
+// ringBufferSize is the number of bytes of each job's stdout and stderr that
+// are kept in memory for streaming
+var ringBufferSize = 64 * 1024
+
+// jobStateFilter selects which jobs are returned when listing jobs.
+type jobStateFilter string
+
+const (
+	filterRunning jobStateFilter = "running"
+	filterExited  jobStateFilter = "exited"
+	filterAll     jobStateFilter = "all"
+)
 
 // Helper Functions
 
-// produceNextJobNumber generates the next job number and sends it to the jobChannel.
-func produceNextJobNumber() {
-	jobNo := datamodel.JobNoType(0)
+// produceNextJobNumber generates the next job number (starting with jobNo)
+// and sends it to the jobChannel.
+func produceNextJobNumber(jobNo datamodel.JobNoType) {
 	for {
 		jobChannel <- jobNo
 		jobNo++
 	}
 }
 
+// secondsToDuration converts a (possibly fractional) number of seconds, as
+// used in the JSON API, to a time.Duration.
+func secondsToDuration(secs float32) time.Duration {
+	return time.Duration(float64(secs) * float64(time.Second))
+}
+
 // writeJson writes the given value as JSON to the response writer.
 func writeJson(v any, w http.ResponseWriter) error {
 	w.Header().Set("Content-Type", "application/json")
@@ -77,88 +108,252 @@ func writeJson(v any, w http.ResponseWriter) error {
 	return nil
 }
 
-// `jobManager` periodically checks the status of running processes and updates
-// the job list. It also responds to requests to list the jobs or delete/kill a
-// job.
-func jobManager() {
-	ticker := time.NewTicker(500 * time.Millisecond)
+// exitStatus describes how a process that has been waited for exited.
+func exitStatus(state *os.ProcessState) *datamodel.JsonExitStruct {
+	exit := &datamodel.JsonExitStruct{
+		EndTime:       time.Now(),
+		ExitCode:      state.ExitCode(),
+		UserCPUSecs:   state.UserTime().Seconds(),
+		SystemCPUSecs: state.SystemTime().Seconds(),
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		exit.Signal = signalName(ws.Signal())
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		exit.MaxRSSKB = rusage.Maxrss // kilobytes on Linux
+	}
+	return exit
+}
+
+// recordExit fills in the exit information of a job whose process has been
+// waited for (or, for an adopted job, has gone away).
+func recordExit(p *datamodel.ProcessJobStruct) {
+	if p.Cmd != nil {
+		p.Exit = exitStatus(p.Cmd.ProcessState)
+	} else {
+		// we weren't its parent, so we don't know how it exited
+		p.Exit = &datamodel.JsonExitStruct{EndTime: time.Now(), ExitCode: -1}
+	}
+	if p.Cgroup != "" {
+		// any processes that the job left behind keep the cgroup alive
+		p.Usage = cgroupUsage(p.Cgroup)
+		if len(cgroupMembers(p.Cgroup)) == 0 {
+			removeCgroup(p.Cgroup)
+		} else {
+			log.Printf("warning: job %v left processes behind in cgroup %v", p.JobNo, p.Cgroup)
+		}
+	}
+	if p.TimedOut {
+		p.State = datamodel.JobTimedOut
+	} else {
+		p.State = datamodel.JobExited
+	}
+}
+
+// jobsToKill is the jobManager's answer to a request to kill jobs: the running
+// jobs, which the caller must kill, and those that had no process to kill and
+// have been stopped already (pending jobs, and jobs waiting to be restarted).
+type jobsToKill struct {
+	running []*datamodel.ProcessJobStruct
+	stopped []datamodel.JsonJobStruct
+}
+
+// `jobManager` keeps track of running (and pending) jobs and a bounded history
+// of finished ones, starting with those restored from the state file (see
+// loadState). It starts pending jobs when they are due, restarts jobs whose
+// restart policy says so, responds to requests to list the jobs or
+// delete/kill a job, and saves the job table whenever it changes.
+func jobManager(running, restoredHistory []*datamodel.ProcessJobStruct, nextJobNo datamodel.JobNoType) {
 	processJobs := make(map[*datamodel.ProcessJobStruct]any)
+	for _, p := range running {
+		processJobs[p] = nil
+		switch p.State {
+		case datamodel.JobPending:
+			go rescheduleJob(p)
+		case datamodel.JobRestarting:
+			go restartAfter(p, 0)
+		default:
+			go watchAdopted(p)
+		}
+	}
+	history := make([]*datamodel.ProcessJobStruct, 0, maxJobHistory)
+	history = append(history, restoredHistory...)
+	// finish moves a job that has finished to the history
+	finish := func(p *datamodel.ProcessJobStruct) {
+		delete(processJobs, p)
+		p.Stdout.Close()
+		p.Stderr.Close()
+		close(p.Done)
+		if maxJobHistory > 0 {
+			if len(history) == maxJobHistory {
+				history = history[1:]
+			}
+			history = append(history, p)
+		}
+	}
+	saveState(nextJobNo, processJobs, history)
 	for {
 		select {
 		case cmd := <-processChannel:
 			// new job, add it to our map
 			processJobs[cmd] = nil
-
-		case <-ticker.C:
-			for p := range processJobs {
-				log.Printf("Checking process %v: %v", p.JobNo, p.Cmd)
-				if p.Cmd.ProcessState != nil {
-					p.Cmd.Wait()
-					delete(processJobs, p)
+			if cmd.JobNo >= nextJobNo {
+				nextJobNo = cmd.JobNo + 1
+			}
+			saveState(nextJobNo, processJobs, history)
+
+		case l := <-jobLaunchChannel:
+			// a pending job is due (or a job is to be restarted), unless it
+			// has been killed meanwhile. (If we're shutting down and it
+			// wasn't killed, it's being kept, and waits until the next run
+			// of the server.)
+			p := l.p
+			if _, ok := processJobs[p]; !ok || isShuttingDown() {
+				break
+			}
+			restarting := p.State == datamodel.JobRestarting
+			err := l.err
+			if err == nil {
+				if restarting {
+					p.Restarts++
+				} else {
+					p.ScheduledAt = &l.due
+				}
+				var watch func()
+				if watch, err = startJob(p); err == nil {
+					if restarting {
+						log.Printf("Restarted job %v (restart %d): %v", p.JobNo, p.Restarts, p.CmdLine)
+					} else {
+						log.Printf("Started job %v (%.3fs late): %v", p.JobNo, p.StartSkewSecs, p.CmdLine)
+					}
+					watch()
+				}
+			}
+			if err != nil {
+				log.Printf("Job %v failed to start: %v", p.JobNo, err)
+				if restarting {
+					// try again later, if the job's restart policy allows
+					now := time.Now()
+					p.LastFailure = "cannot restart: " + err.Error()
+					p.LastFailureAt = &now
+					if delay, ok := restartDelay(p, p.LastFailure); ok {
+						go restartAfter(p, delay)
+						saveState(nextJobNo, processJobs, history)
+						break
+					}
 				}
+				p.State = datamodel.JobFailed
+				p.Error = err.Error()
+				finish(p)
 			}
+			saveState(nextJobNo, processJobs, history)
+
+		case p := <-jobExitChannel:
+			// the job's process has been waited for; restart it if its
+			// restart policy says so, or else move it to the history
+			recordExit(p)
+			log.Printf("Process %v exited: %v (exit code %v)", p.JobNo, p.CmdLine, p.Exit.ExitCode)
+			jobNo := p.JobNo
+			auditExit(p.RequestID, &jobNo, p.Pid, p.Exit)
+			recordJobExit("/runInBackground", p.Exit, p.Exit.EndTime.Sub(p.StartTime))
+			failure := failureReason(p)
+			if failure != "" {
+				endTime := p.Exit.EndTime
+				p.LastFailure = failure
+				p.LastFailureAt = &endTime
+			}
+			if delay, ok := restartDelay(p, failure); ok {
+				p.State = datamodel.JobRestarting
+				recordJobRestart()
+				go restartAfter(p, delay)
+			} else {
+				finish(p)
+			}
+			saveState(nextJobNo, processJobs, history)
 
-		case <-jobListRequestChannel:
+		case filter := <-jobListRequestChannel:
 			jobList := make(jobList, 0, len(processJobs))
-			for p := range processJobs {
-				jobList = append(jobList, struct {
-					JobNo      datamodel.JobNoType `json:"jobNo"`
-					CmdLine    string              `json:"cmdLine"`
-					StdoutFile string              `json:"stdoutFile"`
-					StderrFile string              `json:"stderrFile"`
-				}{
-					JobNo:      p.JobNo,
-					CmdLine:    p.CmdLine,
-					StdoutFile: p.StdoutFile,
-					StderrFile: p.StderrFile,
-				})
+			if filter == filterRunning || filter == filterAll {
+				for p := range processJobs {
+					jobList = append(jobList, p.JsonJobStruct)
+				}
+				sort.Slice(jobList, func(i, j int) bool { return jobList[i].JobNo < jobList[j].JobNo })
+			}
+			if filter == filterExited || filter == filterAll {
+				for _, p := range history {
+					jobList = append(jobList, p.JsonJobStruct)
+				}
 			}
 			jobListResponseChannel <- jobList
 
-		case jobNo := <-jobKillChannel:
+		case jobNo := <-jobTimeoutChannel:
 			for p := range processJobs {
-				if p.JobNo == jobNo || jobNo == -1 {
-					// kill the process
-					log.Printf("Killing process %v: %v", p.JobNo, p.Cmd)
-					// Note: p.Cmd.Wait() is called in goroutine spun off of
-					// handleRunInBackground
-					p.Cmd.Process.Kill()
-					delete(processJobs, p)
+				// (the timeout may be left over from before the job was
+				// restarted)
+				if p.JobNo == jobNo && !p.TimedOut && p.State == datamodel.JobRunning && !time.Now().Before(p.Deadline) {
+					log.Printf("Job %v timed out: %v", p.JobNo, p.CmdLine)
+					p.TimedOut = true
+					go killJob(p, syscall.SIGTERM, defaultKillGrace)
+					saveState(nextJobNo, processJobs, history)
 				}
 			}
-		}
-	}
-}
-
-// Middleware
-
-// authenticationMiddleware is a middleware for validating requests using a session token.
-type authenticationMiddleware struct {
-	authToken string
-}
 
-// Init initializes the authentication middleware by grabbing the token from the environment.
-func (amw *authenticationMiddleware) Init() {
-	amw.authToken = os.Getenv("SERVER_AUTH_TOKEN")
-	if amw.authToken == "" {
-		log.Fatal("SERVER_AUTH_TOKEN not set")
-	}
-}
+		case jobNo := <-jobLookupChannel:
+			var found *datamodel.ProcessJobStruct
+			for p := range processJobs {
+				if p.JobNo == jobNo {
+					found = p
+				}
+			}
+			for _, p := range history {
+				if p.JobNo == jobNo {
+					found = p
+				}
+			}
+			jobLookupResponseChannel <- found
+
+		case match := <-jobKillChannel:
+			// find the jobs to kill; the actual killing (which may take a
+			// while) is done by the caller.
+			// Note: p.Cmd.Wait() is called in goroutine spun off of
+			// handleRunInBackground, which will report the exit back to us
+			// via jobExitChannel
+			// Jobs without a process are simply stopped.
+			var jobs jobsToKill
+			for p := range processJobs {
+				if !match(p) {
+					continue
+				}
+				switch p.State {
+				case datamodel.JobPending:
+					log.Printf("Canceled job %v: %v", p.JobNo, p.CmdLine)
+					p.State = datamodel.JobCanceled
+				case datamodel.JobRestarting:
+					// (its last exit stands)
+					log.Printf("Stopped job %v, instead of restarting it: %v", p.JobNo, p.CmdLine)
+					p.State = datamodel.JobExited
+				default:
+					// don't restart it once it has been killed
+					p.Killed = true
+					jobs.running = append(jobs.running, p)
+					continue
+				}
+				finish(p)
+				jobs.stopped = append(jobs.stopped, p.JsonJobStruct)
+			}
+			if len(jobs.stopped) > 0 {
+				saveState(nextJobNo, processJobs, history)
+			}
+			jobKillResponseChannel <- jobs
 
-// Middleware is the middleware function that will be called for each request.
-func (amw *authenticationMiddleware) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("X-Session-Token")
+		case done := <-jobFlushChannel:
+			saveState(nextJobNo, processJobs, history)
+			close(done)
 
-		if token == amw.authToken {
-			log.Printf("token valid")
-			// Pass down the request to the next middleware (or final handler)
-			next.ServeHTTP(w, r)
-		} else {
-			// Write an error and stop the handler chain
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		case <-jobManagerStopChannel:
+			return
 		}
-	})
+	}
 }
 
 // handleUploadFile handles the client's file upload request.
@@ -167,40 +362,114 @@ func (amw *authenticationMiddleware) Middleware(next http.Handler) http.Handler
 
 func main() {
 	var (
-		certPath string
-		keyPath  string
-		port     string
-		username string
+		certPath  string
+		keyPath   string
+		clientCA  string
+		port      string
+		username  string
+		policy    string
+		tokens    string
+		auditLog  string
+		auditMax  int64
+		auditKeep int
+		keepJobs  bool
+		certCheck time.Duration
+		amw       authenticationMiddleware
 	)
 
 	flag.StringVar(&certPath, "certpath", "", "Path to the certificate file")
 	flag.StringVar(&keyPath, "keypath", "", "Path to the key file")
+	flag.DurationVar(&certCheck, "cert-check", time.Minute, "How often to check whether the certificate and key files have changed, and reload them (0 to only reload on SIGHUP)")
+	flag.StringVar(&clientCA, "client-ca", "", "Path to a PEM file of CA certificates; if set, clients must present a certificate signed by one of them")
 	flag.StringVar(&port, "port", "443", "Port number to listen on")
-	flag.StringVar(&username, "user", "", "User to run as")
+	flag.StringVar(&username, "user", "", "User to run as (after binding the port); jobs run as this user too, unless the policy allows otherwise")
+	flag.StringVar(&tokens, "tokens", "", "Path to a JSON file of named tokens and their roles (default: SERVER_AUTH_TOKEN, as an admin)")
+	flag.BoolVar(&amw.requireSignatures, "require-signatures", false, "Reject requests that aren't signed with HMAC")
+	flag.DurationVar(&amw.signatureSkew, "signature-skew", 30*time.Second, "How far a signed request's timestamp may be from the server's clock")
+	flag.StringVar(&policy, "policy", "", "Path to a JSON file listing the commands that may be run (default: any)")
+	flag.StringVar(&auditLog, "audit", "", "Path to an append-only JSONL audit log of requests and processes (default: none)")
+	flag.Int64Var(&auditMax, "audit-max", 64<<20, "Size (in bytes) at which to rotate the audit log")
+	flag.IntVar(&auditKeep, "audit-keep", 10, "Number of rotated audit logs to keep")
+	flag.StringVar(&stateFile, "state", "", "Path to a file in which to save the job table, so that jobs can be re-adopted after a restart (default: none)")
+	flag.BoolVar(&keepJobs, "keep-jobs", false, "Leave the jobs running, rather than killing them, when shut down by SIGTERM or SIGINT")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "How long to wait for jobs and requests to finish when shutting down")
+	flag.IntVar(&maxJobHistory, "history", maxJobHistory, "Number of finished jobs to remember (0 to remember none)")
+	flag.StringVar(&workspaceRoot, "workspaces", workspaceRoot, "Directory in which to create workspaces")
+	flag.Int64Var(&archiveMaxBytes, "archive-max", archiveMaxBytes, "Largest total size (in bytes) of the files sent by /archive")
+	flag.StringVar(&cgroupRoot, "cgroup-root", "", "cgroup v2 directory under which to put each job in a cgroup of its own, e.g. /sys/fs/cgroup/web-director (default: none, and no resource limits)")
+	flag.IntVar(&ringBufferSize, "ringsize", ringBufferSize, "Bytes of each job's stdout/stderr to keep in memory")
 	flag.Parse()
 
 	if certPath == "" || keyPath == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if maxJobHistory < 0 {
+		fmt.Fprintln(os.Stderr, "-history must not be negative (0 turns the history off)")
+		flag.Usage()
+		os.Exit(1)
+	}
 
 	log.Println("Certificate Path:", certPath)
 	log.Println("Key Path:", keyPath)
 
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
+	var err error
+	if certificates, err = newCertReloader(certPath, keyPath); err != nil {
 		log.Fatal(err)
 	}
 	var tlsconf tls.Config
-	tlsconf.Certificates = make([]tls.Certificate, 1)
-	tlsconf.Certificates[0] = cert
+	tlsconf.GetCertificate = certificates.getCertificate
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsconf.ClientCAs = x509.NewCertPool()
+		if !tlsconf.ClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("%s: no certificates found", clientCA)
+		}
+		tlsconf.ClientAuth = tls.RequireAndVerifyClientCert
+		amw.clientCerts = true
+		log.Println("Client CA Path:", clientCA)
+	}
 	listener, err := tls.Listen("tcp4", ":"+port, &tlsconf)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go jobManager()
-	go produceNextJobNumber()
+	if err := initWorkspaces(); err != nil {
+		log.Fatal(err)
+	}
+	if cgroupRoot != "" {
+		if err := initCgroups(); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("cgroup root:", cgroupRoot)
+	}
+	if policy != "" {
+		if commandPolicy, err = loadPolicy(policy); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded policy with %d rules from %s", len(commandPolicy.Rules), policy)
+	}
+
+	if auditLog != "" {
+		if audit, err = openAuditLog(auditLog, auditMax, auditKeep); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Audit log:", auditLog)
+	}
+
+	var running, history []*datamodel.ProcessJobStruct
+	var nextJobNo datamodel.JobNoType
+	if stateFile != "" {
+		if running, history, nextJobNo, err = loadState(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("State file: %s (re-adopted %d running jobs)", stateFile, len(running))
+	}
+	go jobManager(running, history, nextJobNo)
+	go produceNextJobNumber(nextJobNo)
 
 	r := mux.NewRouter()
 
@@ -209,29 +478,52 @@ func main() {
 	r.HandleFunc("/runToCompletion", handleRunToCompletion)
 	r.HandleFunc("/runInBackground", handleRunInBackground)
 	r.HandleFunc("/jobs", handleJobList)
+	r.HandleFunc("/jobs/{id:[0-9]+}/stream", handleStreamJob)
 	r.HandleFunc("/kill", handleKillJob)
 	r.HandleFunc("/upload", handleUploadFile)
-
-	amw := authenticationMiddleware{}
-	amw.Init()
-	r.Use(amw.Middleware)
-
+	r.HandleFunc("/download", handleDownloadFile)
+	r.HandleFunc("/archive", handleArchive)
+	r.HandleFunc("/workspaces", handleListWorkspaces)
+	r.HandleFunc("/workspaces/{name}", handleWorkspace)
+	r.HandleFunc("/audit", handleAudit)
+	r.HandleFunc("/metrics", handleMetrics)
+	r.HandleFunc("/sysinfo", handleSysInfo)
+
+	amw.Init(tokens)
+	r.Use(metricsMiddleware, auditMiddleware, shutdownMiddleware, amw.Middleware)
+
+	startPrivilegedThread()
 	if username != "" {
 		log.Printf("switching to user %s", username)
-		userInfo, err := user.Lookup(username)
-		if err != nil {
-			log.Fatal(err)
-		}
-		uid, err := strconv.ParseInt(userInfo.Uid, 10, 32)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if err := syscall.Seteuid(int(uid)); err != nil {
+		if err := dropPrivileges(username); err != nil {
 			log.Fatal(err)
 		}
 		log.Printf("now running as user %s", username)
+	} else if u, err := user.Current(); err == nil {
+		serverUser = u.Username
 	}
 
+	go certificates.watch(certCheck)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	server := &http.Server{Handler: r}
+	server.RegisterOnShutdown(func() { close(stopStreaming) })
 	log.Println("Server starting on port " + port)
-	log.Fatal(http.Serve(listener, r))
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	var opts datamodel.JsonShutdownStruct
+	select {
+	case opts = <-shutdownChannel:
+		log.Println("Shutting down, as requested")
+	case sig := <-signals:
+		log.Printf("Shutting down on %v", sig)
+		opts.KeepJobs = keepJobs
+	}
+	shutdown(server, opts)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"datamodel"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jobNumbers starts producing job numbers, once for all the tests
+var jobNumbers sync.Once
+
+// runJobManager runs a jobManager (with no jobs) for the rest of a test, in
+// a new workspace root with a workspace "exp1". The test must wait for its
+// jobs to finish (see waitForJob), since they report to the jobManager.
+func runJobManager(t *testing.T) string {
+	oldRoot := workspaceRoot
+	t.Cleanup(func() { workspaceRoot = oldRoot })
+	workspaceRoot = t.TempDir()
+	root := filepath.Join(workspaceRoot, "exp1")
+	require.NoError(t, os.Mkdir(root, 0755))
+
+	jobNumbers.Do(func() { go produceNextJobNumber(1) })
+	go jobManager(nil, nil, 1)
+	t.Cleanup(func() { jobManagerStopChannel <- struct{}{} })
+	return root
+}
+
+// listJobs lists the jobManager's jobs.
+func listJobs(filter jobStateFilter) jobList {
+	jobListRequestChannel <- filter
+	return <-jobListResponseChannel
+}
+
+// waitForJob waits (for up to timeout) until a job has finished, and returns
+// it as it was moved to the history.
+func waitForJob(t *testing.T, jobNo datamodel.JobNoType, timeout time.Duration) datamodel.JsonJobStruct {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, job := range listJobs(filterExited) {
+			if job.JobNo == jobNo {
+				return job
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "job didn't finish", "job %v is still running after %v", jobNo, timeout)
+	return datamodel.JsonJobStruct{}
+}
+
+// getJobs lists jobs via handleJobList.
+func getJobs(t *testing.T, query string) (int, jobList) {
+	w := httptest.NewRecorder()
+	handleJobList(w, httptest.NewRequest(http.MethodGet, "/jobs?"+query, nil))
+	var jobs jobList
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jobs))
+	}
+	return w.Code, jobs
+}
+
+func TestJobHistory(t *testing.T) {
+	defer func(history int) { maxJobHistory = history }(maxJobHistory)
+	maxJobHistory = 2
+	runJobManager(t)
+
+	failed := runInBackground(t, `{"cmd":"sh","args":["-c","exit 3"],"workspace":"exp1"}`)
+	job := waitForJob(t, failed.JobNo, 5*time.Second)
+	if assert.NotNil(t, job.Exit) {
+		assert.Equal(t, 3, job.Exit.ExitCode)
+		assert.Empty(t, job.Exit.Signal)
+		assert.False(t, job.Exit.EndTime.Before(job.StartTime))
+		assert.Positive(t, job.Exit.MaxRSSKB)
+	}
+	var exited []datamodel.JobNoType
+	for _, args := range []string{`["0"]`, `["0.1"]`} {
+		job := runInBackground(t, `{"cmd":"sleep","args":`+args+`,"workspace":"exp1"}`)
+		waitForJob(t, job.JobNo, 5*time.Second)
+		exited = append(exited, job.JobNo)
+	}
+	running := runInBackground(t, `{"cmd":"sleep","args":["30"],"workspace":"exp1"}`)
+
+	jobNos := func(jobs jobList) []datamodel.JobNoType {
+		var jobNos []datamodel.JobNoType
+		for _, job := range jobs {
+			jobNos = append(jobNos, job.JobNo)
+		}
+		return jobNos
+	}
+	// only the last two finished jobs are remembered, oldest first, and
+	// running jobs are listed first
+	for query, want := range map[string][]datamodel.JobNoType{
+		"":              {running.JobNo},
+		"state=running": {running.JobNo},
+		"state=exited":  exited,
+		"state=all":     append([]datamodel.JobNoType{running.JobNo}, exited...),
+	} {
+		code, jobs := getJobs(t, query)
+		assert.Equal(t, http.StatusOK, code, query)
+		assert.Equal(t, want, jobNos(jobs), query)
+	}
+	code, _ := getJobs(t, "state=finished")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// a killed job records the signal that killed it
+	killJobs(func(p *datamodel.ProcessJobStruct) bool { return p.JobNo == running.JobNo }, syscall.SIGKILL, defaultKillGrace)
+	job = waitForJob(t, running.JobNo, 5*time.Second)
+	if assert.NotNil(t, job.Exit) {
+		assert.Equal(t, "SIGKILL", job.Exit.Signal)
+	}
+	_, jobs := getJobs(t, "state=exited")
+	assert.Equal(t, []datamodel.JobNoType{exited[1], running.JobNo}, jobNos(jobs))
+}
+
+func TestJobTimeout(t *testing.T) {
+	runJobManager(t)
+
+	// the timeout counts from when the job starts, not from when the request
+	// that started it returns
+	start := time.Now()
+	timedOut := runInBackground(t, `{"cmd":"sh","args":["-c","sleep 30 & sleep 30"],"workspace":"exp1","timeout":0.5}`)
+	time.Sleep(200 * time.Millisecond)
+	_, jobs := getJobs(t, "state=running")
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, datamodel.JobRunning, jobs[0].State)
+	}
+
+	// once it's run past its timeout, its whole process group is killed
+	job := waitForJob(t, timedOut.JobNo, 5*time.Second)
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, datamodel.JobTimedOut, job.State)
+	if assert.NotNil(t, job.Exit) {
+		assert.Equal(t, "SIGTERM", job.Exit.Signal)
+	}
+	assert.Eventually(t, func() bool { return len(processGroupMembers(timedOut.Pid)) == 0 }, time.Second, 10*time.Millisecond)
+
+	// a job that finishes in time has simply exited
+	job = waitForJob(t, runInBackground(t, `{"cmd":"true","workspace":"exp1","timeout":5}`).JobNo, 5*time.Second)
+	assert.Equal(t, datamodel.JobExited, job.State)
+}
@@ -1,16 +1,77 @@
 package datamodel
 
-import "os/exec"
+import (
+	"os/exec"
+	"time"
+)
 
 type JobNoType int
 
+// JobStateType is the lifecycle state of a background job.
+type JobStateType string
+
+const (
+	JobRunning  JobStateType = "running"
+	JobExited   JobStateType = "exited"
+	JobTimedOut JobStateType = "timed_out" // killed because it ran past its timeout
+	// JobOrphaned jobs were running when the server stopped, and had gone by
+	// the time it restarted, so how they exited is unknown
+	JobOrphaned JobStateType = "orphaned"
+	// JobPending jobs are being held until their start time (or until the
+	// job they start after has started)
+	JobPending JobStateType = "pending"
+	// JobCanceled jobs were killed before they started, and JobFailed ones
+	// couldn't be started when they were due (see JsonJobStruct.Error)
+	JobCanceled JobStateType = "canceled"
+	JobFailed   JobStateType = "failed"
+	// JobRestarting jobs have exited, and are waiting to be restarted (see
+	// JsonCommandStruct.Restart)
+	JobRestarting JobStateType = "restarting"
+)
+
+// RestartPolicyType says when a background job is restarted after its process
+// exits.
+type RestartPolicyType string
+
+const (
+	RestartNever     RestartPolicyType = "never"
+	RestartOnFailure RestartPolicyType = "on-failure" // a non-zero exit code, or killed by a signal
+	RestartAlways    RestartPolicyType = "always"
+)
+
 // ProcessJobStruct represents a background process job.
 type ProcessJobStruct struct {
-	Cmd        *exec.Cmd
-	JobNo      JobNoType
-	CmdLine    string
-	StdoutFile string
-	StderrFile string
+	Cmd    *exec.Cmd
+	Stdout *RingBuffer // recent output, kept in memory for streaming
+	Stderr *RingBuffer
+	// TimedOut is set once the job has been killed for running past its
+	// timeout
+	TimedOut bool
+	// RequestID is the id of the request that started the job, for the
+	// audit log
+	RequestID string
+	// StartTicks is the process's start time (in clock ticks since boot, as
+	// in /proc/<pid>/stat), which tells it apart from a later process that
+	// reuses its pid
+	StartTicks uint64
+	// Deadline is when the job times out, if it has a timeout
+	Deadline time.Time
+	// Identity is the name of the client that started the job, for the
+	// audit log
+	Identity string
+	// Command is the command that the job runs, with its output files
+	// resolved
+	Command JsonCommandStruct
+	// Started is closed once the job's process has started, and Done once
+	// the job has finished (including being canceled, or failing to start)
+	Started chan struct{}
+	Done    chan struct{}
+	// Killed is set once the job has been killed (by "/kill", or because the
+	// server is shutting down), so that it isn't restarted
+	Killed bool
+	// RestartBackoff is how long the job last waited to be restarted
+	RestartBackoff time.Duration
+	JsonJobStruct
 }
 
 // JsonCommandStruct represents a command to be executed.
@@ -20,10 +81,268 @@ type JsonCommandStruct struct {
 	Args          []string `json:"args"`
 	StdoutFile    string   `json:"stdout"`
 	StderrFile    string   `json:"stderr"`
+	// Workspace is the name of the workspace to run the command in. If it
+	// is empty, the "default" workspace is used instead (and background
+	// jobs are listed as running in it).
+	Workspace string `json:"workspace"`
+	// Cwd is the working directory of the command, relative to the
+	// workspace; it defaults to the workspace itself (and is created if
+	// necessary). Relative output files are relative to it.
+	Cwd string `json:"cwd"`
+	// Env is merged into the server's environment, or replaces it entirely
+	// if ClearEnv is set
+	Env      map[string]string `json:"env"`
+	ClearEnv bool              `json:"clearEnv"`
+	// Resources limits what the command may use; this needs the server to
+	// have been given a cgroup root
+	Resources JsonResourcesStruct `json:"resources"`
+	// User to run the command as; the server's own user if empty. Other
+	// users must be allowed by the server's policy.
+	User string `json:"user"`
+	// Labels are free-form key=value pairs (e.g. exp=foo, role=bridge) by
+	// which background jobs can be listed and killed
+	Labels map[string]string `json:"labels"`
+	// StartAt holds a background job until the given (wall-clock) time, and
+	// StartAfterJob until the job with that number has started; if both are
+	// set, the job waits for both
+	StartAt       *time.Time `json:"startAt,omitempty"`
+	StartAfterJob *JobNoType `json:"startAfterJob,omitempty"`
+	// Restart says when a background job is restarted after its process
+	// exits ("never", the default, "on-failure" or "always"). It's restarted
+	// at most MaxRestarts times (0 means no limit), after a delay that
+	// starts at RestartBackoffInSecs (1 by default) and doubles each time.
+	Restart              RestartPolicyType `json:"restart,omitempty"`
+	MaxRestarts          int               `json:"maxRestarts,omitempty"`
+	RestartBackoffInSecs float32           `json:"restartBackoff,omitempty"`
+	// ReadyWhen, if set, makes "/runInBackground" wait until the job is
+	// ready before returning
+	ReadyWhen *JsonReadyWhenStruct `json:"readyWhen,omitempty"`
+}
+
+// JsonReadyWhenStruct says when a background job is ready (e.g. once it's
+// listening for connections). Every condition that is set must hold.
+type JsonReadyWhenStruct struct {
+	Port   int    `json:"port,omitempty"`   // a TCP port is being listened on (by any process)
+	Output string `json:"output,omitempty"` // a regular expression has matched the job's stdout or stderr
+	// File exists; it's relative to the job's working directory, and must
+	// be inside its workspace
+	File          string  `json:"file,omitempty"`
+	TimeoutInSecs float32 `json:"timeout,omitempty"` // how long to wait; 0 means the default (30s)
+}
+
+// JsonResourcesStruct gives the resource limits of a command, which are
+// enforced by putting it in a cgroup of its own. Zero means no limit.
+type JsonResourcesStruct struct {
+	CPUQuota  float32 `json:"cpuQuota,omitempty"`  // in CPUs, e.g. 0.5 for half of one CPU
+	MemoryMax int64   `json:"memoryMax,omitempty"` // in bytes
+	PidsMax   int     `json:"pidsMax,omitempty"`   // number of processes (and threads)
+	IOWeight  int     `json:"ioWeight,omitempty"`  // relative weight, 1-10000 (the default is 100)
+}
+
+// JsonUsageStruct reports the resources used by a job's cgroup.
+type JsonUsageStruct struct {
+	CPUSecs         float64 `json:"cpuSecs"`
+	MemoryBytes     int64   `json:"memoryBytes"`
+	MemoryPeakBytes int64   `json:"memoryPeakBytes"`
+	Pids            int     `json:"pids"`
+	OOMKills        int     `json:"oomKills"`
 }
 
 // JsonKillStruct represents a job to be killed.
 // note that  if job == -1, then all jobs will be killed
 type JsonKillStruct struct {
-	JobNo JobNoType `json:"job"`
+	JobNo       JobNoType `json:"job"`
+	Signal      string    `json:"signal"` // e.g. "SIGTERM" (the default), "INT" or "9"
+	GraceInSecs float32   `json:"grace"`  // time to wait before escalating to SIGKILL; 0 means the default
+	// Selector, if set, kills the running jobs whose labels match it (e.g.
+	// "exp=foo,role=bridge") instead of JobNo. It must not be empty.
+	Selector *string `json:"selector,omitempty"`
+}
+
+// JsonShutdownStruct says what the server should do with its jobs when told
+// to shut down via "/exit".
+type JsonShutdownStruct struct {
+	// KeepJobs leaves the jobs running, e.g. to be re-adopted by an upgraded
+	// server; otherwise they are killed
+	KeepJobs    bool    `json:"keepJobs"`
+	Signal      string  `json:"signal"` // to kill the jobs with; SIGTERM by default
+	GraceInSecs float32 `json:"grace"`  // time to wait before escalating to SIGKILL; 0 means the default
+}
+
+// JsonKillResultStruct reports what happened when a job was killed.
+type JsonKillResultStruct struct {
+	JobNo     JobNoType `json:"jobNo"`
+	Pgid      int       `json:"pgid"`
+	Pids      []int     `json:"pids"` // processes in the job's process group when it was signalled
+	Signal    string    `json:"signal"`
+	Escalated bool      `json:"escalated"`          // true if SIGKILL was needed after the grace period
+	Reaped    bool      `json:"reaped"`             // true if every process in the group is gone
+	Canceled  bool      `json:"canceled,omitempty"` // true if the job had no process to kill (it was pending, or waiting to be restarted)
+}
+
+// JsonJobStruct describes a background job, as returned by the server when
+// the job is started and when listing jobs.
+type JsonJobStruct struct {
+	JobNo      JobNoType       `json:"jobNo"`
+	Pid        int             `json:"pid"`
+	CmdLine    string          `json:"cmdLine"`
+	Workspace  string          `json:"workspace,omitempty"`
+	Cwd        string          `json:"cwd"` // absolute path
+	StartTime  time.Time       `json:"startTime"`
+	StdoutFile string          `json:"stdoutFile"` // absolute path, empty if not saved
+	StderrFile string          `json:"stderrFile"` // absolute path, empty if not saved
+	State      JobStateType    `json:"state"`
+	Exit       *JsonExitStruct `json:"exit,omitempty"` // nil while the job is running
+	// User is the user that the job runs as, if not the server's
+	User string `json:"user,omitempty"`
+	// Cgroup is the job's cgroup, if the server puts jobs in cgroups
+	Cgroup string `json:"cgroup,omitempty"`
+	// Usage is read from the job's cgroup (when the job is listed, or when
+	// it exits)
+	Usage *JsonUsageStruct `json:"usage,omitempty"`
+	// Labels are the labels of the command that started the job
+	Labels map[string]string `json:"labels,omitempty"`
+	// Adopted is set if the job was started by a previous run of the server.
+	// Its output can only be streamed if it's saved to files, and if it
+	// exits, its exit code is reported as -1.
+	Adopted bool `json:"adopted,omitempty"`
+	// ScheduledAt is when a held job was due to start, and StartSkewSecs how
+	// long after that it actually started
+	ScheduledAt   *time.Time `json:"scheduledAt,omitempty"`
+	StartSkewSecs float64    `json:"startSkewSecs,omitempty"`
+	// Error says why a job failed to start
+	Error string `json:"error,omitempty"`
+	// Restarts is how many times the job's process has been restarted, and
+	// LastFailure how it last failed (e.g. "exit code 1" or "killed by
+	// SIGSEGV"), and when
+	Restarts      int        `json:"restarts,omitempty"`
+	LastFailure   string     `json:"lastFailure,omitempty"`
+	LastFailureAt *time.Time `json:"lastFailureAt,omitempty"`
+}
+
+// JsonExitStruct describes how a background job finished and what resources
+// it used.
+type JsonExitStruct struct {
+	EndTime       time.Time `json:"endTime"`
+	ExitCode      int       `json:"exitCode"`         // -1 if terminated by a signal
+	Signal        string    `json:"signal,omitempty"` // terminating signal, if any
+	UserCPUSecs   float64   `json:"userCpuSecs"`
+	SystemCPUSecs float64   `json:"systemCpuSecs"`
+	MaxRSSKB      int64     `json:"maxRssKB"`
+}
+
+// JsonCertificateStruct describes the server's TLS certificate.
+type JsonCertificateStruct struct {
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dnsNames"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	LoadedAt  time.Time `json:"loadedAt"` // when the server (re)loaded it
+}
+
+// JsonWorkspaceStruct describes a workspace on the server.
+type JsonWorkspaceStruct struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// AuditEventType says what an audit log record is about.
+type AuditEventType string
+
+const (
+	AuditRequest AuditEventType = "request" // an API call, once it has been handled
+	AuditStart   AuditEventType = "start"   // a process was started
+	AuditExit    AuditEventType = "exit"    // a process exited
+	AuditUpload  AuditEventType = "upload"  // a file was uploaded
+)
+
+// JsonAuditStruct is a record in the server's audit log. Which fields are set
+// depends on the event.
+type JsonAuditStruct struct {
+	Time       time.Time      `json:"time"`
+	Event      AuditEventType `json:"event"`
+	RequestID  string         `json:"requestId,omitempty"`
+	RemoteAddr string         `json:"remoteAddr,omitempty"`
+	Identity   string         `json:"identity,omitempty"`
+	Method     string         `json:"method,omitempty"`
+	Endpoint   string         `json:"endpoint,omitempty"` // path and query
+	Status     int            `json:"status,omitempty"`
+	// JobNo is only set for background jobs
+	JobNo     *JobNoType      `json:"jobNo,omitempty"`
+	Pid       int             `json:"pid,omitempty"`
+	Cmd       string          `json:"cmd,omitempty"`
+	Args      []string        `json:"args,omitempty"`
+	User      string          `json:"user,omitempty"`
+	Workspace string          `json:"workspace,omitempty"`
+	Cwd       string          `json:"cwd,omitempty"`
+	Exit      *JsonExitStruct `json:"exit,omitempty"`
+	File      string          `json:"file,omitempty"`
+	Size      int64           `json:"size,omitempty"`
+	SHA256    string          `json:"sha256,omitempty"`
+}
+
+// JsonSysInfoStruct describes the health of a server's host.
+type JsonSysInfoStruct struct {
+	Hostname      string                `json:"hostname"`
+	KernelVersion string                `json:"kernelVersion"`
+	UptimeSecs    float64               `json:"uptimeSecs"`
+	LoadAvg       [3]float64            `json:"loadAvg"` // over 1, 5 and 15 minutes
+	NumCPU        int                   `json:"numCpu"`
+	CPU           JsonCPUStruct         `json:"cpu"`
+	Memory        JsonMemoryStruct      `json:"memory"`
+	Disk          JsonDiskStruct        `json:"disk"`
+	Interfaces    []JsonInterfaceStruct `json:"interfaces"`
+	Listening     []JsonSocketStruct    `json:"listening"` // listening TCP sockets
+}
+
+// JsonCPUStruct gives the CPU time (summed over all CPUs) spent in each mode
+// since boot. The difference between two samples gives recent usage.
+type JsonCPUStruct struct {
+	UserSecs   float64 `json:"userSecs"` // including nice
+	SystemSecs float64 `json:"systemSecs"`
+	IdleSecs   float64 `json:"idleSecs"`
+	IOWaitSecs float64 `json:"iowaitSecs"`
+	OtherSecs  float64 `json:"otherSecs"` // interrupts, steal, etc.
+	// BusyPercent is the percentage of CPU time that wasn't idle (or
+	// waiting for I/O) over the requested sampling interval, if any
+	BusyPercent *float64 `json:"busyPercent,omitempty"`
+}
+
+// JsonMemoryStruct describes memory usage, in bytes.
+type JsonMemoryStruct struct {
+	TotalBytes     int64 `json:"totalBytes"`
+	AvailableBytes int64 `json:"availableBytes"` // an estimate of how much can be allocated without swapping
+	FreeBytes      int64 `json:"freeBytes"`
+	SwapTotalBytes int64 `json:"swapTotalBytes"`
+	SwapFreeBytes  int64 `json:"swapFreeBytes"`
+}
+
+// JsonDiskStruct describes the space on the filesystem holding a directory.
+type JsonDiskStruct struct {
+	Path           string `json:"path"`
+	TotalBytes     int64  `json:"totalBytes"`
+	FreeBytes      int64  `json:"freeBytes"`
+	AvailableBytes int64  `json:"availableBytes"` // free space that unprivileged users may use
+}
+
+// JsonInterfaceStruct gives the traffic counters of a network interface.
+type JsonInterfaceStruct struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rxBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxErrors  uint64 `json:"rxErrors"`
+	RxDropped uint64 `json:"rxDropped"`
+	TxBytes   uint64 `json:"txBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	TxErrors  uint64 `json:"txErrors"`
+	TxDropped uint64 `json:"txDropped"`
+}
+
+// JsonSocketStruct describes a listening socket.
+type JsonSocketStruct struct {
+	Proto   string `json:"proto"` // "tcp" or "tcp6"
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	UID     int    `json:"uid"`
 }
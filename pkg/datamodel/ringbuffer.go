@@ -0,0 +1,128 @@
+package datamodel
+
+import "sync"
+
+// RingBuffer keeps the most recent output of a job in memory. Offsets are
+// absolute positions in the output stream (i.e., the number of bytes written
+// before them), so that readers can resume where they left off even after
+// older output has been overwritten. The buffer only grows (up to its size)
+// as output is written, since most jobs write far less than that.
+type RingBuffer struct {
+	mu      sync.Mutex
+	buf     []byte
+	size    int64         // how much output is remembered
+	total   int64         // number of bytes ever written
+	closed  bool          // no more writes will happen
+	changed chan struct{} // closed (and replaced) whenever the buffer changes
+}
+
+// NewRingBuffer creates a RingBuffer that remembers the last size bytes.
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{
+		size:    int64(size),
+		changed: make(chan struct{}),
+	}
+}
+
+// grow makes room for n more bytes of output, if the buffer isn't full-size
+// yet. Until it is, the output is stored from its start, as though the
+// buffer had wrapped around. It must be called with the lock held.
+func (rb *RingBuffer) grow(n int64) {
+	need := rb.total + n
+	if need > rb.size {
+		need = rb.size
+	}
+	if need <= int64(len(rb.buf)) {
+		return
+	}
+	if need <= int64(cap(rb.buf)) {
+		rb.buf = rb.buf[:need]
+		return
+	}
+	// (like append, double the capacity to keep copying down)
+	capacity := 2 * int64(cap(rb.buf))
+	if capacity < need {
+		capacity = need
+	}
+	if capacity > rb.size {
+		capacity = rb.size
+	}
+	buf := make([]byte, need, capacity)
+	copy(buf, rb.buf)
+	rb.buf = buf
+}
+
+// notify wakes up everyone waiting for the buffer to change. It must be
+// called with the lock held.
+func (rb *RingBuffer) notify() {
+	close(rb.changed)
+	rb.changed = make(chan struct{})
+}
+
+// Write appends p to the buffer, overwriting the oldest output if necessary.
+func (rb *RingBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	n := len(p)
+	size := rb.size
+	if size == 0 {
+		rb.total += int64(n)
+		rb.notify()
+		return n, nil
+	}
+	// only the tail of a very large write can possibly be kept
+	if int64(len(p)) > size {
+		rb.total += int64(len(p)) - size
+		p = p[int64(len(p))-size:]
+	}
+	rb.grow(int64(len(p)))
+	for len(p) > 0 {
+		c := copy(rb.buf[rb.total%size:], p)
+		p = p[c:]
+		rb.total += int64(c)
+	}
+	rb.notify()
+	return n, nil
+}
+
+// Close marks the end of the output. Readers that are following the buffer
+// are woken up.
+func (rb *RingBuffer) Close() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if !rb.closed {
+		rb.closed = true
+		rb.notify()
+	}
+	return nil
+}
+
+// Snapshot returns the output available at or after offset. If offset refers
+// to output that has already been overwritten, the returned data starts at the
+// oldest output still available; start reports the offset of the first
+// returned byte. closed reports whether the buffer has been closed, and
+// changed is closed the next time the buffer is written to or closed.
+func (rb *RingBuffer) Snapshot(offset int64) (data []byte, start int64, closed bool, changed <-chan struct{}) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	size := rb.size
+	oldest := rb.total - size
+	if oldest < 0 {
+		oldest = 0
+	}
+	if offset < oldest {
+		offset = oldest
+	}
+	if offset > rb.total {
+		offset = rb.total
+	}
+
+	data = make([]byte, rb.total-offset)
+	for i := int64(0); i < int64(len(data)); {
+		pos := (offset + i) % size
+		i += int64(copy(data[i:], rb.buf[pos:]))
+	}
+	return data, offset, rb.closed, rb.changed
+}
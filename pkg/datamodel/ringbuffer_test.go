@@ -0,0 +1,110 @@
+package datamodel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRingBufferSnapshot(t *testing.T) {
+	rb := NewRingBuffer(8)
+	rb.Write([]byte("hello"))
+
+	data, start, closed, _ := rb.Snapshot(0)
+	if string(data) != "hello" || start != 0 || closed {
+		t.Fatalf("got %q at %d (closed=%v)", data, start, closed)
+	}
+
+	data, start, _, _ = rb.Snapshot(3)
+	if string(data) != "lo" || start != 3 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+}
+
+func TestRingBufferWrapAround(t *testing.T) {
+	rb := NewRingBuffer(8)
+	rb.Write([]byte("abcdef"))
+	rb.Write([]byte("ghijk"))
+
+	// "abc" has been overwritten, so reading from the start skips ahead
+	data, start, _, _ := rb.Snapshot(0)
+	if string(data) != "defghijk" || start != 3 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+
+	data, start, _, _ = rb.Snapshot(9)
+	if string(data) != "jk" || start != 9 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+
+	// reading past the end returns nothing
+	data, start, _, _ = rb.Snapshot(100)
+	if len(data) != 0 || start != 11 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+}
+
+func TestRingBufferLargeWrite(t *testing.T) {
+	rb := NewRingBuffer(4)
+	n, err := rb.Write([]byte(strings.Repeat("x", 10) + "1234"))
+	if n != 14 || err != nil {
+		t.Fatalf("write returned %d, %v", n, err)
+	}
+	data, start, _, _ := rb.Snapshot(0)
+	if string(data) != "1234" || start != 10 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+}
+
+func TestRingBufferNotify(t *testing.T) {
+	rb := NewRingBuffer(4)
+	_, _, _, changed := rb.Snapshot(0)
+
+	rb.Write([]byte("a"))
+	select {
+	case <-changed:
+	default:
+		t.Fatal("write did not signal a change")
+	}
+
+	_, _, _, changed = rb.Snapshot(0)
+	rb.Close()
+	select {
+	case <-changed:
+	default:
+		t.Fatal("close did not signal a change")
+	}
+	if _, _, closed, _ := rb.Snapshot(0); !closed {
+		t.Fatal("buffer not closed")
+	}
+}
+
+func TestRingBufferGrowsLazily(t *testing.T) {
+	rb := NewRingBuffer(16)
+	if cap(rb.buf) != 0 {
+		t.Fatalf("allocated %d bytes before any output", cap(rb.buf))
+	}
+	rb.Write([]byte("abc"))
+	rb.Write([]byte("de"))
+	if len(rb.buf) != 5 || cap(rb.buf) > 16 {
+		t.Fatalf("buffer is %d bytes (capacity %d) after 5 bytes of output", len(rb.buf), cap(rb.buf))
+	}
+	data, start, _, _ := rb.Snapshot(0)
+	if string(data) != "abcde" || start != 0 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+
+	// it stops growing once it's full-size, and then wraps around
+	rb.Write([]byte("fghijklmnopqrstu"))
+	if len(rb.buf) != 16 || cap(rb.buf) != 16 {
+		t.Fatalf("buffer is %d bytes (capacity %d)", len(rb.buf), cap(rb.buf))
+	}
+	data, start, _, _ = rb.Snapshot(0)
+	if string(data) != "fghijklmnopqrstu" || start != 5 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+	rb.Write([]byte("vw"))
+	data, start, _, _ = rb.Snapshot(0)
+	if string(data) != "hijklmnopqrstuvw" || start != 7 {
+		t.Fatalf("got %q at %d", data, start)
+	}
+}
@@ -0,0 +1,33 @@
+package datamodel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Headers used by signed requests, in place of X-Session-Token
+const (
+	TimestampHeader = "X-Auth-Timestamp" // seconds since the Unix epoch
+	NonceHeader     = "X-Auth-Nonce"     // random, never reused
+	SignatureHeader = "X-Auth-Signature" // hex-encoded, see SignRequest
+)
+
+// SignRequest computes the signature of a request: the HMAC-SHA256, keyed by
+// the client's token, of the method, request URI (path and query),
+// timestamp, nonce and SHA-256 hash of the body, each on its own line.
+func SignRequest(key []byte, method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		method,
+		requestURI,
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}